@@ -12,6 +12,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/sebnyberg/imgcrop/internal/exp/tiffx"
 	"github.com/sebnyberg/imgcrop/internal/exp/vipsx"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/image/tiff"
@@ -92,6 +93,12 @@ func BenchmarkTIFF(b *testing.B) {
 							name: "vipsimage",
 							fn:   nil,
 						},
+						{
+							name: "tiffx",
+							fn: func(src io.Reader, dst io.Writer, region image.Rectangle) error {
+								return tiffx.CropAt(src.(io.ReaderAt), dst, region)
+							},
+						},
 					} {
 						b.Run(fmt.Sprintf("%dX%d-%s", dx, dy, cropper.name), func(b *testing.B) {
 							var f *os.File
@@ -140,7 +147,7 @@ func doInit() {
 	}
 
 	createUncompressed := func() error {
-		// Create uncompressed version of big TIFF
+		// Create uncompressed version of big TIFF, one strip at a time
 		_, err := os.Stat(tiffBigUncompressedPath)
 		if err == nil {
 			return nil
@@ -149,15 +156,13 @@ func doInit() {
 		if err != nil {
 			return err
 		}
+		defer in.Close()
 		out, err := os.OpenFile(tiffBigUncompressedPath, outflags, 0644)
 		if err != nil {
 			return err
 		}
-		img, err := tiff.Decode(in)
-		if err != nil {
-			return err
-		}
-		return tiff.Encode(out, img, nil)
+		defer out.Close()
+		return tiffx.Convert(in, out)
 	}
 	err := createUncompressed()
 	if err != nil {
@@ -9,6 +9,8 @@ import (
 	"io"
 	"os"
 	"path"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
 )
 
 // CropFile crops the provided region of the BMP found at srcPath to a BMP at
@@ -26,10 +28,33 @@ func CropFile(srcPath, dstPath string, region image.Rectangle) error {
 	return Crop(src, dst, region)
 }
 
+// Options are the cropping options. A nil *Options means the defaults.
+type Options struct {
+	// RLE sets whether an RLE8 or RLE4 compressed input is cropped to an image
+	// with the same compression. By default, the cropped image is
+	// uncompressed. Since the size of the compressed image is not known until
+	// it has been written, dst must be an io.WriteSeeker so that the header can
+	// be updated.
+	RLE bool
+}
+
 // Crop crops the provided region of the BMP found in the input stream to the
 // output stream.
 //
-// The input BMP must be bottom-up, no alpha, and uncompressed.
+// Both bottom-up and top-down images are supported, and the cropped image
+// retains the row order of the input. Paletted images with 1, 2, 4 or 8 bits
+// per pixel keep their palette, and rows of images with less than 8 bits per
+// pixel are bit-shifted when the region does not start on a byte boundary.
+// Images with 16 or 32 bits per pixel may have arbitrary channel masks
+// (BI_BITFIELDS), which are copied to the cropped image as-is. Images with an
+// alpha channel (BITMAPV4HEADER and BITMAPV5HEADER) are cropped as-is, and any
+// ICC profile stored after the pixel data is carried over to the cropped
+// image.
+//
+// RLE8 and RLE4 compressed images are decoded one row at a time and cropped to
+// an uncompressed image, see CropWithOptions for keeping the compression.
+// Compressed images with an ICC profile after the pixel data are not
+// supported.
 //
 // Thanks to the simplicity of the BMP format, crop uses a very small amount of
 // memory (~8KiB).
@@ -41,17 +66,20 @@ func CropFile(srcPath, dstPath string, region image.Rectangle) error {
 // columns. Depending on the data and number of crops, it may make sense to
 // rotate the image accordingly.
 func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
+	return CropWithOptions(src, dst, region, nil)
+}
+
+// CropWithOptions is like Crop, but with options.
+func CropWithOptions(src io.Reader, dst io.Writer, region image.Rectangle, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+
 	// Load BMP header bytes and significant content
 	hdr, err := DecodeHeader(src)
 	if err != nil {
 		return err
 	}
-	if hdr.TopDown {
-		return errors.New(".BMP: topDown not supported")
-	}
-	if hdr.AllowAlpha {
-		return errors.New(".BMP: allowAlpha not supported")
-	}
 
 	// Find / validate crop area
 	dim := image.Rect(0, 0, hdr.Config.Width, hdr.Config.Height)
@@ -60,39 +88,26 @@ func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
 		return errors.New("crop area empty or out of bounds")
 	}
 
-	// Create updated BMP header with crop dimensions
-	totalSize := (hdr.BitsPerPixel/8)*(region.Dx()*region.Dy()) + len(hdr.HeaderBytes)
-	width := region.Dx()
-	height := region.Dy()
-	binary.LittleEndian.PutUint32(hdr.HeaderBytes[2:6], uint32(totalSize))
-	binary.LittleEndian.PutUint32(hdr.HeaderBytes[18:22], uint32(width))
-	binary.LittleEndian.PutUint32(hdr.HeaderBytes[22:26], uint32(height))
-	_, err = dst.Write(hdr.HeaderBytes)
+	if hdr.RLE {
+		return cropRLE(src, dst, hdr, region, opts.RLE)
+	}
+
+	// Write updated BMP header with crop dimensions
+	err = writeHeader(dst, hdr, region.Dx(), region.Dy())
 	if err != nil {
 		return err
 	}
 
-	bytesPerPixel := hdr.BitsPerPixel / 8
-
-	// Seek if possible, otherwise copy to discard
-	var seek func(off int) (n int64, err error)
-	if s, ok := src.(io.Seeker); ok {
-		seek = func(off int) (n int64, err error) {
-			return s.Seek(int64(off), io.SeekCurrent)
-		}
-	} else {
-		seek = func(off int) (n int64, err error) {
-			return io.CopyN(io.Discard, src, int64(off))
-		}
-	}
+	seek := ioutilx.Skipper(src)
 
-	byteWidth := func(pixels, bitsPerPixel int) int {
-		return ((pixels*bitsPerPixel + 31) / 32) * 4
+	// Skip rows that precede the cropping region in the file. Bottom-up images
+	// store the last row first, top-down images store the first row first.
+	rowBytes := byteWidth(hdr.Config.Width, hdr.BitsPerPixel)
+	skipRows := hdr.Config.Height - region.Max.Y
+	if hdr.TopDown {
+		skipRows = region.Min.Y
 	}
-
-	// Skip uncropped last rows (recall: bmp is bottom-up in this case)
-	rowBytes := byteWidth(hdr.BitsPerPixel, hdr.Config.Width)
-	skipBytes := rowBytes * (hdr.Config.Height - region.Max.Y)
+	skipBytes := rowBytes * skipRows
 	if _, err := seek(skipBytes); err != nil {
 		return err
 	}
@@ -102,11 +117,23 @@ func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
 	// 4-byte aligned. This means that there may be extra bytes that are empty
 	// on each row that is being read, and that padding may need to be added to
 	// the row that is being written.
-	left := bytesPerPixel * region.Min.X
-	mid := region.Dx() * bytesPerPixel
-	right := rowBytes - (mid + left)
-	wantWidth := byteWidth(hdr.BitsPerPixel, region.Dx())
+	//
+	// For images with less than 8 bits per pixel, the cropped row may start in
+	// the middle of a byte. Such rows are read into a buffer and shifted so that
+	// the first pixel of the region is put in the most significant bits.
+	startBit := hdr.BitsPerPixel * region.Min.X
+	midBits := hdr.BitsPerPixel * region.Dx()
+	shift := uint(startBit % 8)
+	left := startBit / 8
+	span := (int(shift) + midBits + 7) / 8
+	mid := (midBits + 7) / 8
+	right := rowBytes - (span + left)
+	wantWidth := byteWidth(region.Dx(), hdr.BitsPerPixel)
 	padding := make([]byte, wantWidth-mid)
+	var buf []byte
+	if hdr.BitsPerPixel < 8 {
+		buf = make([]byte, span)
+	}
 
 	for dy := 1; dy <= region.Dy(); dy++ {
 		// Skip left
@@ -116,9 +143,19 @@ func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
 		}
 
 		// Write middle part with padding
-		n, err := io.CopyN(dst, src, int64(mid))
-		if err != nil || n != int64(mid) {
-			return err
+		if buf == nil {
+			n, err := io.CopyN(dst, src, int64(mid))
+			if err != nil || n != int64(mid) {
+				return err
+			}
+		} else {
+			if _, err := io.ReadFull(src, buf); err != nil {
+				return err
+			}
+			cropBits(buf, shift, midBits)
+			if _, err := dst.Write(buf[:mid]); err != nil {
+				return err
+			}
 		}
 		_, err = dst.Write(padding)
 		if err != nil {
@@ -132,7 +169,61 @@ func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
 		}
 	}
 
-	return nil
+	if !hdr.trailingProfile() {
+		return nil
+	}
+
+	// The ICC profile is stored after the pixel data. Skip the remaining rows
+	// and copy the profile to directly after the cropped pixel data.
+	pos := int(hdr.ImageOffset) + rowBytes*(skipRows+region.Dy())
+	_, err = seek(fileHeaderLen + int(hdr.ProfileOffset) - pos)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(dst, src, int64(hdr.ProfileSize))
+	return err
+}
+
+// byteWidth returns the number of bytes in a 4-byte aligned row of pixels.
+func byteWidth(pixels, bitsPerPixel int) int {
+	return ((pixels*bitsPerPixel + 31) / 32) * 4
+}
+
+// cropBits shifts the bits of b left by shift bits and clears any bits past
+// the first n bits, which would otherwise hold pixels outside of the region.
+func cropBits(b []byte, shift uint, n int) {
+	if shift > 0 {
+		for i := 0; i < len(b)-1; i++ {
+			b[i] = b[i]<<shift | b[i+1]>>(8-shift)
+		}
+		b[len(b)-1] <<= shift
+	}
+	if extra := uint(-n & 7); extra > 0 {
+		b[(n-1)/8] &^= 1<<extra - 1
+	}
+}
+
+// writeHeader writes the header bytes of hdr to w, updated to describe an
+// image with the provided dimensions.
+func writeHeader(w io.Writer, hdr DecodeResult, width, height int) error {
+	b := hdr.HeaderBytes
+	imageSize := byteWidth(width, hdr.BitsPerPixel) * height
+	fileSize := len(b) + imageSize
+	if hdr.trailingProfile() {
+		// The profile is put directly after the pixel data
+		binary.LittleEndian.PutUint32(b[126:130], uint32(fileSize-fileHeaderLen))
+		fileSize += int(hdr.ProfileSize)
+	}
+	if hdr.TopDown {
+		// A negative height marks the rows as being stored top-down
+		height = -height
+	}
+	binary.LittleEndian.PutUint32(b[2:6], uint32(fileSize))
+	binary.LittleEndian.PutUint32(b[18:22], uint32(width))
+	binary.LittleEndian.PutUint32(b[22:26], uint32(int32(height)))
+	binary.LittleEndian.PutUint32(b[34:38], uint32(imageSize))
+	_, err := w.Write(b)
+	return err
 }
 
 type DecodeResult struct {
@@ -142,8 +233,58 @@ type DecodeResult struct {
 	AllowAlpha   bool
 	HeaderBytes  []byte
 	ImageOffset  uint32
+
+	// RLE reports whether the pixel data is run-length encoded, using RLE8 or
+	// RLE4 depending on BitsPerPixel.
+	RLE bool
+
+	// RedMask, GreenMask, BlueMask and AlphaMask are the channel masks of
+	// images with 16, 24 or 32 bits per pixel. The masks are either read from
+	// the header (BI_BITFIELDS) or set to the defaults of the pixel depth.
+	// AlphaMask is zero for images without an alpha channel.
+	RedMask   uint32
+	GreenMask uint32
+	BlueMask  uint32
+	AlphaMask uint32
+
+	// ProfileOffset and ProfileSize locate the ICC profile data of a
+	// BITMAPV5HEADER image. The offset is relative to the start of the info
+	// header. Both are zero when the image has no profile.
+	ProfileOffset uint32
+	ProfileSize   uint32
 }
 
+// trailingProfile reports whether the image has an ICC profile that is stored
+// after the header bytes, i.e. after the pixel data.
+func (res DecodeResult) trailingProfile() bool {
+	return res.ProfileSize > 0 && fileHeaderLen+res.ProfileOffset >= res.ImageOffset
+}
+
+// We only support those BMP images with one of the following DIB headers:
+// - BITMAPINFOHEADER (40 bytes)
+// - BITMAPV4HEADER (108 bytes)
+// - BITMAPV5HEADER (124 bytes)
+const (
+	fileHeaderLen   = 14
+	infoHeaderLen   = 40
+	v4InfoHeaderLen = 108
+	v5InfoHeaderLen = 124
+)
+
+// Compression methods.
+const (
+	compressionNone      = 0 // BI_RGB
+	compressionRLE8      = 1 // BI_RLE8
+	compressionRLE4      = 2 // BI_RLE4
+	compressionBitfields = 3 // BI_BITFIELDS
+)
+
+// Color space types of BITMAPV5HEADER images which reference profile data.
+const (
+	profileLinked   = 0x4c494e4b // 'LINK'
+	profileEmbedded = 0x4d424544 // 'MBED'
+)
+
 // bmpDecodeHeader was shamelessly copied from 'x/image/bmp' and edited for the
 // usecase in this repo. Unlike the stdlib implementation, the header and
 // palette bytes are retained so that they can be re-written to cropped images.
@@ -155,16 +296,6 @@ func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
 		return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
 	}
 
-	// We only support those BMP images with one of the following DIB headers:
-	// - BITMAPINFOHEADER (40 bytes)
-	// - BITMAPV4HEADER (108 bytes)
-	// - BITMAPV5HEADER (124 bytes)
-	const (
-		fileHeaderLen   = 14
-		infoHeaderLen   = 40
-		v4InfoHeaderLen = 108
-		v5InfoHeaderLen = 124
-	)
 	var empty DecodeResult
 	var b [2048]byte
 	if _, err := io.ReadFull(r, b[:fileHeaderLen+4]); err != nil {
@@ -177,6 +308,9 @@ func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
 		return empty, errors.New("bmp: invalid format")
 	}
 	offset := readUint32(b[10:14])
+	if int(offset) > len(b) {
+		return empty, errors.New("unsupported")
+	}
 	res.ImageOffset = offset
 	res.HeaderBytes = b[:offset]
 	infoLen := readUint32(b[14:18])
@@ -189,6 +323,13 @@ func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
 		}
 		return empty, err
 	}
+	if infoLen == v5InfoHeaderLen {
+		switch readUint32(b[70:74]) {
+		case profileLinked, profileEmbedded:
+			res.ProfileOffset = readUint32(b[126:130])
+			res.ProfileSize = readUint32(b[130:134])
+		}
+	}
 	width := int(int32(readUint32(b[18:22])))
 	height := int(int32(readUint32(b[22:26])))
 	if height < 0 {
@@ -197,50 +338,98 @@ func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
 	if width < 0 || height < 0 {
 		return empty, errors.New("unsupported")
 	}
-	// We only support 1 plane and 8, 24 or 32 bits per pixel and no
-	// compression.
+	// We only support 1 plane and 1, 2, 4, 8, 16, 24 or 32 bits per pixel.
+	// Images with 16 or 32 bits per pixel may use arbitrary channel masks, and
+	// images with 4 or 8 bits per pixel may be run-length encoded.
 	planes, bpp, compression := readUint16(b[26:28]), readUint16(b[28:30]), readUint32(b[30:34])
-	// if compression is set to BI_BITFIELDS, but the bitmask is set to the default bitmask
-	// that would be used if compression was set to 0, we can continue as if compression was 0
-	if compression == 3 && infoLen > infoHeaderLen &&
-		readUint32(b[54:58]) == 0xff0000 && readUint32(b[58:62]) == 0xff00 &&
-		readUint32(b[62:66]) == 0xff && readUint32(b[66:70]) == 0xff000000 {
-		compression = 0
-	}
-	if planes != 1 || compression != 0 {
+	if planes != 1 {
+		return empty, errors.New("unsupported")
+	}
+	read := fileHeaderLen + infoLen
+	switch compression {
+	case compressionNone:
+	case compressionRLE8, compressionRLE4:
+		// RLE images must be bottom-up
+		if res.TopDown || (compression == compressionRLE8) != (bpp == 8) ||
+			(compression == compressionRLE4) != (bpp == 4) {
+			return empty, errors.New("unsupported")
+		}
+		res.RLE = true
+	case compressionBitfields:
+		if bpp != 16 && bpp != 32 {
+			return empty, errors.New("unsupported")
+		}
+		// BITMAPV4HEADER and later headers hold the masks. For the smaller
+		// BITMAPINFOHEADER, the red, green and blue masks follow the header.
+		if infoLen == infoHeaderLen {
+			if err := readRest(r, b[:], read, read+12); err != nil {
+				return empty, err
+			}
+			read += 12
+		} else {
+			res.AlphaMask = readUint32(b[66:70])
+		}
+		res.RedMask = readUint32(b[54:58])
+		res.GreenMask = readUint32(b[58:62])
+		res.BlueMask = readUint32(b[62:66])
+		if bpp == 16 && (res.RedMask|res.GreenMask|res.BlueMask|res.AlphaMask)>>16 != 0 {
+			return empty, errors.New("unsupported")
+		}
+	default:
 		return empty, errors.New("unsupported")
 	}
 	switch bpp {
-	case 8:
-		if offset != fileHeaderLen+infoLen+256*4 {
+	case 1, 2, 4, 8:
+		// The palette has as many colors as are in use, or all colors that
+		// can be represented by the pixel depth when unset.
+		colors := int(readUint32(b[46:50]))
+		if colors == 0 || colors > 1<<bpp {
+			colors = 1 << bpp
+		}
+		pre := int(read)
+		if int(offset) < pre+colors*4 {
 			return empty, errors.New("unsupported")
 		}
-		pre := fileHeaderLen + int(infoLen)
-		_, err = io.ReadFull(r, b[pre:pre+256*4])
-		if err != nil {
+		if err := readRest(r, b[:], read, offset); err != nil {
 			return empty, err
 		}
-		pcm := make(color.Palette, 256)
+		pcm := make(color.Palette, colors)
 		for i := range pcm {
 			// BMP images are stored in BGR order rather than RGB order.
 			// Every 4th byte is padding.
 			pcm[i] = color.RGBA{b[pre+4*i+2], b[pre+4*i+1], b[pre+4*i+0], 0xFF}
 		}
 		res.Config = image.Config{ColorModel: pcm, Width: width, Height: height}
-		res.BitsPerPixel = 8
+		res.BitsPerPixel = int(bpp)
 		res.AllowAlpha = false
 		return res, nil
+	case 16:
+		if err := readRest(r, b[:], read, offset); err != nil {
+			return empty, err
+		}
+		if compression == compressionNone {
+			// Without masks, each channel has 5 bits and the top bit is unused
+			res.RedMask, res.GreenMask, res.BlueMask = 0x7c00, 0x3e0, 0x1f
+		}
+		res.Config = image.Config{ColorModel: color.RGBAModel, Width: width, Height: height}
+		res.BitsPerPixel = 16
+		res.AllowAlpha = res.AlphaMask != 0
+		return res, nil
 	case 24:
-		if offset != fileHeaderLen+infoLen {
+		if compression != compressionNone {
 			return empty, errors.New("unsupported")
 		}
+		if err := readRest(r, b[:], read, offset); err != nil {
+			return empty, err
+		}
+		res.RedMask, res.GreenMask, res.BlueMask = 0xff0000, 0xff00, 0xff
 		res.Config = image.Config{ColorModel: color.RGBAModel, Width: width, Height: height}
 		res.BitsPerPixel = 24
 		res.AllowAlpha = false
 		return res, nil
 	case 32:
-		if offset != fileHeaderLen+infoLen {
-			return empty, errors.New("unsupported")
+		if err := readRest(r, b[:], read, offset); err != nil {
+			return empty, err
 		}
 		// 32 bits per pixel is possibly RGBX (X is padding) or RGBA (A is
 		// alpha transparency). However, for BMP images, "Alpha is a
@@ -263,10 +452,33 @@ func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
 		// infoHeaderLen) condition distinguishes BITMAPINFOHEADER (40 bytes)
 		// vs later (larger) headers.
 		res.AllowAlpha = infoLen > infoHeaderLen
+		if compression == compressionNone {
+			res.RedMask, res.GreenMask, res.BlueMask = 0xff0000, 0xff00, 0xff
+			if res.AllowAlpha {
+				res.AlphaMask = 0xff000000
+			}
+		} else {
+			// Explicit masks tell whether there is an alpha channel
+			res.AllowAlpha = res.AlphaMask != 0
+		}
 		res.Config = image.Config{ColorModel: color.RGBAModel, Width: width, Height: height}
 		res.BitsPerPixel = 32
-		res.AllowAlpha = infoLen > infoHeaderLen
 		return res, nil
 	}
 	return empty, errors.New("unsupported")
 }
+
+// readRest reads the remaining header bytes b[from:to] that precede the pixel
+// data, such as an embedded ICC profile.
+func readRest(r io.Reader, b []byte, from, to uint32) error {
+	if to < from || int(to) > len(b) {
+		return errors.New("unsupported")
+	}
+	if _, err := io.ReadFull(r, b[from:to]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
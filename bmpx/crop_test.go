@@ -2,6 +2,7 @@ package bmpx
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"image"
@@ -63,23 +64,133 @@ func TestResize(t *testing.T) {
 		var orig, cropped bytes.Buffer
 		err := bmp.Encode(&orig, img)
 		require.NoError(t, err)
-		offx := rand.Intn(w)
-		offy := rand.Intn(h)
-		dx := rand.Intn(w - offx)
-		dy := rand.Intn(h - offy)
-		region := image.Rect(offx, offy, offx+dx, offy+dy)
-		err = Crop(&orig, &cropped, region)
+		src := withInfoHeader(t, orig.Bytes(), v4InfoHeaderLen, nil)
+		region := randRegion(w, h)
+		err = Crop(bytes.NewReader(src), &cropped, region)
 		require.NoError(t, err)
 		got, err := bmp.Decode(&cropped)
 		require.NoError(t, err)
 		want, err := stdlibCrop(img, region)
 		require.NoError(t, err)
-		for y := 0; y < h; y++ {
-			for x := 0; x < w; x++ {
-				gotxy := got.At(x, y)
-				wantxy := want.At(x, y)
-				require.Equal(t, gotxy, wantxy, "(%v,%v)", x, y)
+		requireImageEqual(t, want, got)
+	}
+}
+
+func TestCropProfile(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		img := randRGBA(w, h)
+		var orig, cropped bytes.Buffer
+		err := bmp.Encode(&orig, img)
+		require.NoError(t, err)
+		profile := make([]byte, 1+rand.Intn(100))
+		rand.Read(profile)
+		src := withInfoHeader(t, orig.Bytes(), v5InfoHeaderLen, profile)
+		region := randRegion(w, h)
+		err = Crop(bytes.NewReader(src), &cropped, region)
+		require.NoError(t, err)
+
+		// The profile should be found right after the pixel data
+		b := cropped.Bytes()
+		hdr, err := DecodeHeader(bytes.NewReader(b))
+		require.NoError(t, err)
+		require.True(t, hdr.AllowAlpha)
+		require.Equal(t, uint32(len(b)), binary.LittleEndian.Uint32(b[2:6]))
+		start := fileHeaderLen + int(hdr.ProfileOffset)
+		require.Equal(t, int(hdr.ImageOffset)+4*region.Dx()*region.Dy(), start)
+		require.Equal(t, profile, b[start:start+int(hdr.ProfileSize)])
+
+		got, err := bmp.Decode(&cropped)
+		require.NoError(t, err)
+		want, err := stdlibCrop(img, region)
+		require.NoError(t, err)
+		requireImageEqual(t, want, got)
+	}
+}
+
+func TestCropTopDown(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		img := randRGB(w, h)
+		var orig, cropped bytes.Buffer
+		err := bmp.Encode(&orig, img)
+		require.NoError(t, err)
+		src := toTopDown(t, orig.Bytes())
+		region := randRegion(w, h)
+		err = Crop(bytes.NewReader(src), &cropped, region)
+		require.NoError(t, err)
+		hdr, err := DecodeHeader(bytes.NewReader(cropped.Bytes()))
+		require.NoError(t, err)
+		require.True(t, hdr.TopDown)
+		got, err := bmp.Decode(&cropped)
+		require.NoError(t, err)
+		want, err := stdlibCrop(img, region)
+		require.NoError(t, err)
+		requireImageEqual(t, want, got)
+	}
+}
+
+func TestCropPaletted(t *testing.T) {
+	for _, bpp := range []int{1, 2, 4, 8} {
+		for i := 0; i < 100; i++ {
+			w := 1 + rand.Intn(200)
+			h := 1 + rand.Intn(200)
+			img := randPaletted(w, h, bpp)
+			src := encodePaletted(t, img, bpp)
+			region := randRegion(w, h)
+			want := encodePaletted(t, img.SubImage(region).(*image.Paletted), bpp)
+			if i%2 == 1 {
+				src = toTopDown(t, src)
+				want = toTopDown(t, want)
+			}
+			var cropped bytes.Buffer
+			err := Crop(bytes.NewReader(src), &cropped, region)
+			require.NoError(t, err)
+			require.Equal(t, want, cropped.Bytes(), "%v bpp, region %v", bpp, region)
+		}
+	}
+}
+
+func TestCropBitfields(t *testing.T) {
+	for _, tc := range []struct {
+		bpp     int
+		infoLen int
+		masks   [4]uint32
+	}{
+		{16, infoHeaderLen, [4]uint32{0xf800, 0x7e0, 0x1f, 0}},
+		{16, infoHeaderLen, [4]uint32{0x7c00, 0x3e0, 0x1f, 0}},
+		{16, v4InfoHeaderLen, [4]uint32{0xf00, 0xf0, 0xf, 0xf000}},
+		{32, infoHeaderLen, [4]uint32{0x3ff00000, 0xffc00, 0x3ff, 0}},
+		{32, v5InfoHeaderLen, [4]uint32{0xff, 0xff00, 0xff0000, 0xff000000}},
+	} {
+		for i := 0; i < 20; i++ {
+			w := 1 + rand.Intn(200)
+			h := 1 + rand.Intn(200)
+			pix := make([][]uint32, h)
+			for y := range pix {
+				pix[y] = make([]uint32, w)
+				for x := range pix[y] {
+					pix[y][x] = rand.Uint32() >> (32 - tc.bpp)
+				}
 			}
+			src := encodeBitfields(t, pix, tc.bpp, tc.infoLen, tc.masks)
+			hdr, err := DecodeHeader(bytes.NewReader(src))
+			require.NoError(t, err)
+			require.Equal(t, tc.masks, [4]uint32{hdr.RedMask, hdr.GreenMask, hdr.BlueMask, hdr.AlphaMask})
+			require.Equal(t, tc.masks[3] != 0, hdr.AllowAlpha)
+
+			region := randRegion(w, h)
+			croppedPix := make([][]uint32, region.Dy())
+			for y := range croppedPix {
+				croppedPix[y] = pix[region.Min.Y+y][region.Min.X:region.Max.X]
+			}
+			want := encodeBitfields(t, croppedPix, tc.bpp, tc.infoLen, tc.masks)
+			var cropped bytes.Buffer
+			err = Crop(bytes.NewReader(src), &cropped, region)
+			require.NoError(t, err)
+			require.Equal(t, want, cropped.Bytes(), "%+v, region %v", tc, region)
 		}
 	}
 }
@@ -253,9 +364,183 @@ func stdlibCrop(img image.Image, rect image.Rectangle) (image.Image, error) {
 	if !ok {
 		return nil, errors.New("image does not support sub-imaging")
 	}
-	img = subimg.SubImage(rect)
-	fixedCoords := draw.Draw(img, rect, img)
-	return subimg.SubImage(rect), nil
+	// Move the cropped image to the origin so that it shares coordinates with a
+	// decoded crop.
+	res := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(res, res.Bounds(), subimg.SubImage(rect), rect.Min, draw.Src)
+	return res, nil
+}
+
+func requireImageEqual(t *testing.T, want, got image.Image) {
+	require.Equal(t, want.Bounds(), got.Bounds())
+	for y := want.Bounds().Min.Y; y < want.Bounds().Max.Y; y++ {
+		for x := want.Bounds().Min.X; x < want.Bounds().Max.X; x++ {
+			wr, wg, wb, wa := want.At(x, y).RGBA()
+			gr, gg, gb, ga := got.At(x, y).RGBA()
+			require.Equal(t, [4]uint32{wr, wg, wb, wa}, [4]uint32{gr, gg, gb, ga}, "(%v,%v)", x, y)
+		}
+	}
+}
+
+// randRegion returns a random non-empty region within a w x h image.
+func randRegion(w, h int) image.Rectangle {
+	offx := rand.Intn(w)
+	offy := rand.Intn(h)
+	dx := 1 + rand.Intn(w-offx)
+	dy := 1 + rand.Intn(h-offy)
+	return image.Rect(offx, offy, offx+dx, offy+dy)
+}
+
+// toTopDown flips the rows of an uncompressed bottom-up BMP and negates its
+// height so that it becomes top-down.
+func toTopDown(t *testing.T, b []byte) []byte {
+	hdr, err := DecodeHeader(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.False(t, hdr.TopDown)
+	res := make([]byte, len(b))
+	copy(res, b[:hdr.ImageOffset])
+	rowBytes := ((hdr.Config.Width*hdr.BitsPerPixel + 31) / 32) * 4
+	for i := 0; i < hdr.Config.Height; i++ {
+		from := int(hdr.ImageOffset) + i*rowBytes
+		to := int(hdr.ImageOffset) + (hdr.Config.Height-1-i)*rowBytes
+		copy(res[to:to+rowBytes], b[from:from+rowBytes])
+	}
+	height := -int32(hdr.Config.Height)
+	binary.LittleEndian.PutUint32(res[22:26], uint32(height))
+	return res
+}
+
+// withInfoHeader replaces the BITMAPINFOHEADER of a 32-bit BMP with a
+// BITMAPV4HEADER or BITMAPV5HEADER that has an alpha mask. If a profile is
+// provided, it is embedded after the pixel data.
+func withInfoHeader(t *testing.T, b []byte, infoLen int, profile []byte) []byte {
+	hdr, err := DecodeHeader(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, 32, hdr.BitsPerPixel)
+	pix := b[hdr.ImageOffset:]
+	offset := fileHeaderLen + infoLen
+	res := make([]byte, offset, offset+len(pix)+len(profile))
+	copy(res, b[:fileHeaderLen+infoHeaderLen])
+	le := binary.LittleEndian
+	le.PutUint32(res[2:6], uint32(offset+len(pix)+len(profile)))
+	le.PutUint32(res[10:14], uint32(offset))
+	le.PutUint32(res[14:18], uint32(infoLen))
+	le.PutUint32(res[30:34], 3) // BI_BITFIELDS
+	le.PutUint32(res[54:58], 0xff0000)
+	le.PutUint32(res[58:62], 0xff00)
+	le.PutUint32(res[62:66], 0xff)
+	le.PutUint32(res[66:70], 0xff000000)
+	le.PutUint32(res[70:74], 0x73524742) // 'sRGB'
+	if profile != nil {
+		require.Equal(t, v5InfoHeaderLen, infoLen)
+		le.PutUint32(res[70:74], profileEmbedded)
+		le.PutUint32(res[126:130], uint32(offset+len(pix)-fileHeaderLen))
+		le.PutUint32(res[130:134], uint32(len(profile)))
+	}
+	res = append(res, pix...)
+	return append(res, profile...)
+}
+
+// encodePaletted encodes img as an uncompressed bottom-up BMP with the
+// provided number of bits per pixel. Unlike x/image/bmp, any pixel depth of 8
+// bits or less is supported.
+func encodePaletted(t *testing.T, img *image.Paletted, bpp int) []byte {
+	require.LessOrEqual(t, len(img.Palette), 1<<bpp)
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	rowBytes := byteWidth(w, bpp)
+	offset := fileHeaderLen + infoHeaderLen + 4*len(img.Palette)
+	b := make([]byte, offset+rowBytes*h)
+	le := binary.LittleEndian
+	copy(b, "BM")
+	le.PutUint32(b[2:6], uint32(len(b)))
+	le.PutUint32(b[10:14], uint32(offset))
+	le.PutUint32(b[14:18], infoHeaderLen)
+	le.PutUint32(b[18:22], uint32(w))
+	le.PutUint32(b[22:26], uint32(h))
+	le.PutUint16(b[26:28], 1)
+	le.PutUint16(b[28:30], uint16(bpp))
+	le.PutUint32(b[34:38], uint32(rowBytes*h))
+	le.PutUint32(b[46:50], uint32(len(img.Palette)))
+	for i, c := range img.Palette {
+		r, g, bl, _ := c.RGBA()
+		p := fileHeaderLen + infoHeaderLen + 4*i
+		b[p], b[p+1], b[p+2] = uint8(bl>>8), uint8(g>>8), uint8(r>>8)
+	}
+	for y := 0; y < h; y++ {
+		row := b[offset+(h-1-y)*rowBytes:]
+		for x := 0; x < w; x++ {
+			idx := img.ColorIndexAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+			bit := x * bpp
+			row[bit/8] |= idx << (8 - bpp - bit%8)
+		}
+	}
+	return b
+}
+
+// encodeBitfields encodes rows of raw pixel values as a bottom-up BI_BITFIELDS
+// BMP. The alpha mask is only stored when the info header is larger than
+// BITMAPINFOHEADER.
+func encodeBitfields(t *testing.T, pix [][]uint32, bpp, infoLen int, masks [4]uint32) []byte {
+	h, w := len(pix), len(pix[0])
+	rowBytes := byteWidth(w, bpp)
+	offset := fileHeaderLen + infoLen
+	if infoLen == infoHeaderLen {
+		require.Zero(t, masks[3])
+		offset += 12
+	}
+	b := make([]byte, offset+rowBytes*h)
+	le := binary.LittleEndian
+	copy(b, "BM")
+	le.PutUint32(b[2:6], uint32(len(b)))
+	le.PutUint32(b[10:14], uint32(offset))
+	le.PutUint32(b[14:18], uint32(infoLen))
+	le.PutUint32(b[18:22], uint32(w))
+	le.PutUint32(b[22:26], uint32(h))
+	le.PutUint16(b[26:28], 1)
+	le.PutUint16(b[28:30], uint16(bpp))
+	le.PutUint32(b[30:34], compressionBitfields)
+	le.PutUint32(b[34:38], uint32(rowBytes*h))
+	le.PutUint32(b[54:58], masks[0])
+	le.PutUint32(b[58:62], masks[1])
+	le.PutUint32(b[62:66], masks[2])
+	if infoLen > infoHeaderLen {
+		le.PutUint32(b[66:70], masks[3])
+	}
+	for y := 0; y < h; y++ {
+		row := b[offset+(h-1-y)*rowBytes:]
+		for x := 0; x < w; x++ {
+			if bpp == 16 {
+				le.PutUint16(row[2*x:], uint16(pix[y][x]))
+			} else {
+				le.PutUint32(row[4*x:], pix[y][x])
+			}
+		}
+	}
+	return b
+}
+
+func randPaletted(w, h, bpp int) *image.Paletted {
+	palette := make(color.Palette, 1<<bpp)
+	for i := range palette {
+		palette[i] = color.RGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), 0xff}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rand.Intn(len(palette)))
+	}
+	return img
+}
+
+func randRGB(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	_, err := rand.Read(img.Pix)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
 }
 
 func randRGBA(w, h int) *image.NRGBA {
@@ -0,0 +1,79 @@
+package bmpx
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+// Encoder writes an uncompressed top-down BMP one row at a time. Since
+// top-down images store their rows top to bottom with a fixed size, each row is
+// written to the output stream as it arrives, so memory use does not depend on
+// the size of the image.
+type Encoder struct {
+	w     io.Writer
+	width int
+	alpha bool
+	buf   []byte
+	rows  int // Number of rows left to write
+}
+
+// NewEncoder writes the header of a top-down BMP with the provided dimensions
+// to w, and returns an encoder for its rows. Images with alpha have 32 bits per
+// pixel and a BITMAPV4HEADER, other images have 24 bits per pixel.
+func NewEncoder(w io.Writer, width, height int, alpha bool) (*Encoder, error) {
+	bpp := 24
+	if alpha {
+		bpp = 32
+	}
+	if width <= 0 || height <= 0 || width > math.MaxInt32 || height > math.MaxInt32 {
+		return nil, errors.New("invalid dimensions")
+	}
+	if int64(byteWidth(width, bpp))*int64(height) > math.MaxUint32-fileHeaderLen-v4InfoHeaderLen {
+		return nil, errors.New("unsupported: image too large")
+	}
+	if _, err := w.Write(newHeader(width, height, bpp, true)); err != nil {
+		return nil, err
+	}
+	return &Encoder{
+		w:     w,
+		width: width,
+		alpha: alpha,
+		buf:   make([]byte, byteWidth(width, bpp)),
+		rows:  height,
+	}, nil
+}
+
+// WriteRow writes the next row of the image, top to bottom. The row holds
+// 8-bit non-premultiplied red, green, blue and alpha samples for each pixel.
+// Alpha is dropped for images without alpha.
+func (e *Encoder) WriteRow(row []byte) error {
+	bytesPerPixel := 3
+	if e.alpha {
+		bytesPerPixel = 4
+	}
+	if len(row) != 4*e.width {
+		return errors.New("invalid row length")
+	}
+	if e.rows == 0 {
+		return errors.New("all rows have been written")
+	}
+	e.rows--
+	for i, j := 0, 0; i < len(row); i, j = i+4, j+bytesPerPixel {
+		e.buf[j], e.buf[j+1], e.buf[j+2] = row[i+2], row[i+1], row[i]
+		if e.alpha {
+			e.buf[j+3] = row[i+3]
+		}
+	}
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// Close checks that all rows of the image have been written. It does not close
+// the underlying writer.
+func (e *Encoder) Close() error {
+	if e.rows > 0 {
+		return errors.New("missing rows")
+	}
+	return nil
+}
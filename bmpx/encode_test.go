@@ -0,0 +1,59 @@
+package bmpx
+
+import (
+	"bytes"
+	"image"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestEncoder(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := 1 + rand.Intn(100)
+		h := 1 + rand.Intn(100)
+		alpha := i%2 == 0
+		src := image.NewNRGBA(image.Rect(0, 0, w, h))
+		rand.Read(src.Pix)
+		if !alpha {
+			for j := 3; j < len(src.Pix); j += 4 {
+				src.Pix[j] = 0xff
+			}
+		}
+
+		var b bytes.Buffer
+		enc, err := NewEncoder(&b, w, h, alpha)
+		require.NoError(t, err)
+		for y := 0; y < h; y++ {
+			require.NoError(t, enc.WriteRow(src.Pix[y*src.Stride:(y+1)*src.Stride]))
+		}
+		require.Error(t, enc.WriteRow(src.Pix[:src.Stride]))
+		require.NoError(t, enc.Close())
+
+		hdr, err := DecodeHeader(bytes.NewReader(b.Bytes()))
+		require.NoError(t, err)
+		require.True(t, hdr.TopDown)
+		img, err := bmp.Decode(&b)
+		require.NoError(t, err)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r0, g0, b0, a0 := src.At(x, y).RGBA()
+				r1, g1, b1, a1 := img.At(x, y).RGBA()
+				require.Equal(t, [4]uint32{r0, g0, b0, a0}, [4]uint32{r1, g1, b1, a1})
+			}
+		}
+	}
+}
+
+func TestEncoderInvalid(t *testing.T) {
+	var b bytes.Buffer
+	_, err := NewEncoder(&b, 0, 1, false)
+	require.Error(t, err)
+	enc, err := NewEncoder(&b, 2, 2, false)
+	require.NoError(t, err)
+	require.Error(t, enc.WriteRow(make([]byte, 4)))
+	require.NoError(t, enc.WriteRow(make([]byte, 8)))
+	require.Error(t, enc.Close())
+}
@@ -0,0 +1,213 @@
+package bmpx
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// CropMany crops each region of the BMP found in the input stream to the
+// output stream with the same index in dsts.
+//
+// Unlike calling Crop once per region, the input is read once from start to
+// end, and each row is written to every region that it overlaps. The cost of
+// cropping many regions, such as tiles of an image, is therefore proportional
+// to a single scan of the image rather than one scan per region. Rows that do
+// not overlap any region are skipped by seeking if src is an io.ReadSeeker.
+//
+// Regions are written in the same format as by Crop, and the same images are
+// supported. Each region must overlap the image. Memory use is bounded by one row of the input image and one row of
+// each region that overlaps the current row.
+func CropMany(src io.Reader, regions []image.Rectangle, dsts []io.Writer) error {
+	if len(regions) != len(dsts) {
+		return errors.New("number of regions and outputs differ")
+	}
+	targets := make([]*cropTarget, len(regions))
+	for i := range regions {
+		dst := dsts[i]
+		targets[i] = &cropTarget{
+			region: regions[i],
+			open: func() (io.Writer, error) {
+				return dst, nil
+			},
+		}
+	}
+
+	hdr, err := DecodeHeader(src)
+	if err != nil {
+		return err
+	}
+	return scan(src, hdr, targets)
+}
+
+// cropTarget is a region that is cropped by scan.
+type cropTarget struct {
+	region image.Rectangle
+
+	// open returns the output stream of the region. It is called right before
+	// the first row of the region is read, so that outputs can be created
+	// lazily.
+	open func() (io.Writer, error)
+
+	// close is called once all rows of the region have been written. It may be
+	// nil.
+	close func() error
+
+	w     io.Writer
+	first int // index of the first row of the region in file order
+	buf   []byte
+}
+
+// scan reads the rows of an image whose header has already been read from src
+// once, in file order, and writes the cropped rows of each target to its
+// output.
+func scan(src io.Reader, hdr DecodeResult, targets []*cropTarget) error {
+	dim := image.Rect(0, 0, hdr.Config.Width, hdr.Config.Height)
+	for i, t := range targets {
+		t.region = dim.Intersect(t.region)
+		if t.region.Empty() {
+			return fmt.Errorf("crop area of region %d empty or out of bounds", i)
+		}
+		t.first = hdr.Config.Height - t.region.Max.Y
+		if hdr.TopDown {
+			t.first = t.region.Min.Y
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool {
+		return targets[i].first < targets[j].first
+	})
+
+	seek := ioutilx.Skipper(src)
+	if hdr.RLE && hdr.trailingProfile() {
+		return errRLEProfile
+	}
+
+	// A trailing ICC profile is needed by the first region to finish, so it is
+	// read upfront.
+	var profile []byte
+	if hdr.trailingProfile() {
+		s, ok := src.(io.Seeker)
+		if !ok {
+			return errors.New("bmp: cropping many regions with a trailing profile requires an io.ReadSeeker")
+		}
+		off := fileHeaderLen + int64(hdr.ProfileOffset) - int64(hdr.ImageOffset)
+		if _, err := s.Seek(off, io.SeekCurrent); err != nil {
+			return err
+		}
+		profile = make([]byte, hdr.ProfileSize)
+		if _, err := io.ReadFull(src, profile); err != nil {
+			return err
+		}
+		if _, err := s.Seek(-off-int64(hdr.ProfileSize), io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+
+	bpp := hdr.BitsPerPixel
+	rowBytes := byteWidth(hdr.Config.Width, bpp)
+	var rle *rleReader
+	var row []byte
+	if hdr.RLE {
+		// RLE images are cropped to uncompressed images
+		binary.LittleEndian.PutUint32(hdr.HeaderBytes[30:34], compressionNone)
+		rle = newRLEReader(src, bpp, hdr.Config.Width)
+	} else {
+		row = make([]byte, rowBytes)
+	}
+
+	var active []*cropTarget
+	var next int
+	var skipped int // Rows to skip before reading the next row
+	for i := 0; i < hdr.Config.Height && (next < len(targets) || len(active) > 0); i++ {
+		for ; next < len(targets) && targets[next].first == i; next++ {
+			t := targets[next]
+			w, err := t.open()
+			if err != nil {
+				return err
+			}
+			if err := writeHeader(w, hdr, t.region.Dx(), t.region.Dy()); err != nil {
+				return err
+			}
+			t.w = w
+			// A shifted row may span one more byte than the cropped row
+			t.buf = make([]byte, byteWidth(t.region.Dx(), bpp)+1)
+			active = append(active, t)
+		}
+
+		// Read the next row
+		switch {
+		case rle != nil:
+			if err := rle.next(); err != nil {
+				return err
+			}
+		case len(active) == 0:
+			skipped++
+		default:
+			if _, err := seek(skipped * rowBytes); err != nil {
+				return err
+			}
+			skipped = 0
+			if _, err := io.ReadFull(src, row); err != nil {
+				return err
+			}
+		}
+
+		// Write the row to all overlapping regions
+		var n int
+		for _, t := range active {
+			out := t.buf[:len(t.buf)-1]
+			if rle != nil {
+				packRow(out, rle.row[t.region.Min.X:t.region.Max.X], bpp)
+			} else {
+				cropRow(t.buf, row, t.region, bpp)
+			}
+			if _, err := t.w.Write(out); err != nil {
+				return err
+			}
+			if i < t.first+t.region.Dy()-1 {
+				active[n] = t
+				n++
+				continue
+			}
+
+			// Last row of the region
+			if profile != nil {
+				if _, err := t.w.Write(profile); err != nil {
+					return err
+				}
+			}
+			if t.close != nil {
+				if err := t.close(); err != nil {
+					return err
+				}
+			}
+			t.w, t.buf = nil, nil
+		}
+		active = active[:n]
+	}
+	return nil
+}
+
+// cropRow copies the pixels of row that are within the columns of region to
+// the start of dst, and clears the remainder of dst. The length of dst must be
+// at least the number of bytes spanned by the region in row.
+func cropRow(dst, row []byte, region image.Rectangle, bpp int) {
+	startBit := bpp * region.Min.X
+	midBits := bpp * region.Dx()
+	shift := uint(startBit % 8)
+	left := startBit / 8
+	span := (int(shift) + midBits + 7) / 8
+	mid := (midBits + 7) / 8
+	copy(dst, row[left:left+span])
+	if bpp < 8 {
+		cropBits(dst[:span], shift, midBits)
+	}
+	for i := mid; i < len(dst); i++ {
+		dst[i] = 0
+	}
+}
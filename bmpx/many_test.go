@@ -0,0 +1,77 @@
+package bmpx
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestCropMany(t *testing.T) {
+	encoders := map[string]func(w, h int) []byte{
+		"rgb": func(w, h int) []byte {
+			var b bytes.Buffer
+			require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+			return b.Bytes()
+		},
+		"rgb-top-down": func(w, h int) []byte {
+			var b bytes.Buffer
+			require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+			return toTopDown(t, b.Bytes())
+		},
+		"profile": func(w, h int) []byte {
+			var b bytes.Buffer
+			require.NoError(t, bmp.Encode(&b, randRGBA(w, h)))
+			return withInfoHeader(t, b.Bytes(), v5InfoHeaderLen, []byte("profile"))
+		},
+		"1bpp": func(w, h int) []byte {
+			return encodePaletted(t, randPaletted(w, h, 1), 1)
+		},
+		"rle4": func(w, h int) []byte {
+			return encodeRLE(t, randRuns(w, h, 4), 4)
+		},
+	}
+	for name, encode := range encoders {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				w := 1 + rand.Intn(200)
+				h := 1 + rand.Intn(200)
+				src := encode(w, h)
+				regions := make([]image.Rectangle, rand.Intn(20))
+				dsts := make([]io.Writer, len(regions))
+				for j := range regions {
+					regions[j] = randRegion(w, h)
+					dsts[j] = &bytes.Buffer{}
+				}
+
+				// Hide the seeker every other iteration
+				var r io.Reader = bytes.NewReader(src)
+				if i%2 == 1 && name != "profile" {
+					r = struct{ io.Reader }{r}
+				}
+				err := CropMany(r, regions, dsts)
+				require.NoError(t, err)
+
+				for j, region := range regions {
+					var want bytes.Buffer
+					err := Crop(bytes.NewReader(src), &want, region)
+					require.NoError(t, err)
+					require.Equal(t, want.Bytes(), dsts[j].(*bytes.Buffer).Bytes(), "region %v", region)
+				}
+			}
+		})
+	}
+}
+
+func TestCropManyOutOfBounds(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, bmp.Encode(&b, randRGB(10, 10)))
+	regions := []image.Rectangle{image.Rect(0, 0, 5, 5), image.Rect(20, 20, 30, 30)}
+	dsts := []io.Writer{io.Discard, io.Discard}
+	err := CropMany(&b, regions, dsts)
+	require.Error(t, err)
+}
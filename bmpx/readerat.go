@@ -0,0 +1,156 @@
+package bmpx
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// CropAt crops the provided region of the BMP found in src to the output
+// stream, in the same format as Crop.
+//
+// Unlike Crop, which reads src sequentially, rows are read at absolute offsets
+// computed from the image offset of the header. The offset of src is never
+// changed, so many goroutines may crop from the same src (such as an
+// *os.File) concurrently.
+//
+// RLE compressed images are not supported, since their rows do not have fixed
+// offsets.
+func CropAt(src io.ReaderAt, dst io.Writer, region image.Rectangle) error {
+	hdr, region, err := decodeHeaderAt(src, region)
+	if err != nil {
+		return err
+	}
+	if err := writeHeader(dst, hdr, region.Dx(), region.Dy()); err != nil {
+		return err
+	}
+	err = cropRowsAt(src, hdr, region, 0, region.Dy(), func(_ int, row []byte) error {
+		_, err := dst.Write(row)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return copyProfileAt(src, hdr, func(profile []byte) error {
+		_, err := dst.Write(profile)
+		return err
+	})
+}
+
+// CropAtParallel is like CropAt, but splits the rows of the region into n
+// bands that are cropped by n goroutines. Since rows of the cropped image have
+// a fixed size, each band is written at its final offset in dst.
+func CropAtParallel(src io.ReaderAt, dst io.WriterAt, region image.Rectangle, n int) error {
+	hdr, region, err := decodeHeaderAt(src, region)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := writeHeader(&b, hdr, region.Dx(), region.Dy()); err != nil {
+		return err
+	}
+	if _, err := dst.WriteAt(b.Bytes(), 0); err != nil {
+		return err
+	}
+
+	if n < 1 {
+		n = 1
+	}
+	if n > region.Dy() {
+		n = region.Dy()
+	}
+	headerLen := int64(len(hdr.HeaderBytes))
+	rowLen := int64(byteWidth(region.Dx(), hdr.BitsPerPixel))
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		from := i * region.Dy() / n
+		to := (i + 1) * region.Dy() / n
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = cropRowsAt(src, hdr, region, from, to, func(j int, row []byte) error {
+				_, err := dst.WriteAt(row, headerLen+int64(j)*rowLen)
+				return err
+			})
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	end := headerLen + int64(region.Dy())*rowLen
+	return copyProfileAt(src, hdr, func(profile []byte) error {
+		_, err := dst.WriteAt(profile, end)
+		return err
+	})
+}
+
+// decodeHeaderAt decodes the header of the BMP in src and validates the region.
+func decodeHeaderAt(src io.ReaderAt, region image.Rectangle) (DecodeResult, image.Rectangle, error) {
+	hdr, err := DecodeHeader(io.NewSectionReader(src, 0, math.MaxInt64))
+	if err != nil {
+		return hdr, region, err
+	}
+	if hdr.RLE {
+		return hdr, region, errors.New("bmp: RLE images can not be cropped at offsets")
+	}
+	dim := image.Rect(0, 0, hdr.Config.Width, hdr.Config.Height)
+	region = dim.Intersect(region)
+	if region.Empty() {
+		return hdr, region, errors.New("crop area empty or out of bounds")
+	}
+	return hdr, region, nil
+}
+
+// cropRowsAt reads the rows of the region with indices [from, to) in file order
+// from src and calls write with the index and contents of each cropped row.
+func cropRowsAt(src io.ReaderAt, hdr DecodeResult, region image.Rectangle, from, to int, write func(i int, row []byte) error) error {
+	rowBytes := byteWidth(hdr.Config.Width, hdr.BitsPerPixel)
+	first := hdr.Config.Height - region.Max.Y
+	if hdr.TopDown {
+		first = region.Min.Y
+	}
+	// Only the bytes spanned by the region are read. They start at pixel x0,
+	// which is a whole pixel since rows of less than 8 bits per pixel hold a
+	// whole number of pixels in each byte.
+	bpp := hdr.BitsPerPixel
+	left := bpp * region.Min.X / 8
+	x0 := left * 8 / bpp
+	spanned := image.Rect(region.Min.X-x0, 0, region.Max.X-x0, 1)
+	row := make([]byte, (bpp*spanned.Max.X+7)/8)
+
+	// A shifted row may span one more byte than the cropped row
+	buf := make([]byte, byteWidth(region.Dx(), bpp)+1)
+	for i := from; i < to; i++ {
+		off := int64(hdr.ImageOffset) + int64(first+i)*int64(rowBytes) + int64(left)
+		if err := ioutilx.ReadFullAt(src, row, off); err != nil {
+			return err
+		}
+		cropRow(buf, row, spanned, bpp)
+		if err := write(i, buf[:len(buf)-1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyProfileAt reads a trailing ICC profile from src and passes it to write.
+func copyProfileAt(src io.ReaderAt, hdr DecodeResult, write func(profile []byte) error) error {
+	if !hdr.trailingProfile() {
+		return nil
+	}
+	profile := make([]byte, hdr.ProfileSize)
+	if err := ioutilx.ReadFullAt(src, profile, fileHeaderLen+int64(hdr.ProfileOffset)); err != nil {
+		return err
+	}
+	return write(profile)
+}
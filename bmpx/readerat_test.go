@@ -0,0 +1,90 @@
+package bmpx
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestCropAt(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		var src []byte
+		switch i % 3 {
+		case 0:
+			var b bytes.Buffer
+			require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+			src = toTopDown(t, b.Bytes())
+		case 1:
+			var b bytes.Buffer
+			require.NoError(t, bmp.Encode(&b, randRGBA(w, h)))
+			src = withInfoHeader(t, b.Bytes(), v5InfoHeaderLen, []byte("profile"))
+		case 2:
+			src = encodePaletted(t, randPaletted(w, h, 2), 2)
+		}
+		r := bytes.NewReader(src)
+
+		// Crop many regions concurrently from the same reader
+		regions := make([]image.Rectangle, 8)
+		got := make([]bytes.Buffer, len(regions))
+		errs := make([]error, len(regions))
+		var wg sync.WaitGroup
+		for j := range regions {
+			regions[j] = randRegion(w, h)
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				errs[j] = CropAt(r, &got[j], regions[j])
+			}(j)
+		}
+		wg.Wait()
+		for j, region := range regions {
+			require.NoError(t, errs[j])
+			var want bytes.Buffer
+			err := Crop(bytes.NewReader(src), &want, region)
+			require.NoError(t, err)
+			require.Equal(t, want.Bytes(), got[j].Bytes(), "region %v", region)
+		}
+	}
+}
+
+func TestCropAtParallel(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+		src := b.Bytes()
+		region := randRegion(w, h)
+
+		f, err := os.Create(filepath.Join(t.TempDir(), "cropped.bmp"))
+		require.NoError(t, err)
+		err = CropAtParallel(bytes.NewReader(src), f, region, 1+rand.Intn(8))
+		require.NoError(t, err)
+		_, err = f.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		got, err := io.ReadAll(f)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		var want bytes.Buffer
+		err = Crop(bytes.NewReader(src), &want, region)
+		require.NoError(t, err)
+		require.Equal(t, want.Bytes(), got, "region %v", region)
+	}
+}
+
+func TestCropAtRLE(t *testing.T) {
+	src := encodeRLE(t, randRuns(10, 10, 8), 8)
+	err := CropAt(bytes.NewReader(src), io.Discard, image.Rect(0, 0, 5, 5))
+	require.Error(t, err)
+}
@@ -0,0 +1,428 @@
+package bmpx
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// Filter is a resampling filter used when resizing images.
+type Filter int
+
+const (
+	// Box averages the source pixels that are covered by each pixel of the
+	// resized image. It can only be used to downscale images. For integer
+	// scaling factors, each pixel is the average of a block of factor x factor
+	// source pixels.
+	Box Filter = iota
+
+	// Bilinear interpolates between the four source pixels that are nearest to
+	// the center of each pixel of the resized image.
+	Bilinear
+)
+
+// Resize scales the BMP found in the input stream to the provided size and
+// writes it to the output stream. See CropResize for details.
+func Resize(src io.Reader, dst io.Writer, size image.Point, filter Filter) error {
+	return CropResize(src, dst, image.Rect(0, 0, math.MaxInt32, math.MaxInt32), size, filter)
+}
+
+// CropResize crops the provided region of the BMP found in the input stream,
+// scales it to the provided size and writes it to the output stream.
+//
+// The image is resized row by row as it is read, so memory use is bounded by a
+// few rows of the input and output images, regardless of the image height.
+// Rows outside of the region are skipped as in Crop.
+//
+// Since pixels are blended, the resized image is not written in the pixel
+// format of the input. Images with an alpha channel are written with 32 bits
+// per pixel (BITMAPV4HEADER), other images with 24 bits per pixel. The row
+// order of the input is retained.
+func CropResize(src io.Reader, dst io.Writer, region image.Rectangle, size image.Point, filter Filter) error {
+	hdr, err := DecodeHeader(src)
+	if err != nil {
+		return err
+	}
+	dim := image.Rect(0, 0, hdr.Config.Width, hdr.Config.Height)
+	region = dim.Intersect(region)
+	if region.Empty() {
+		return errors.New("crop area empty or out of bounds")
+	}
+	if size.X <= 0 || size.Y <= 0 {
+		return errors.New("resize dimensions must be positive")
+	}
+	switch filter {
+	case Box:
+		if size.X > region.Dx() || size.Y > region.Dy() {
+			return errors.New("box filter can not be used for upscaling")
+		}
+	case Bilinear:
+	default:
+		return errors.New("unknown filter")
+	}
+
+	bpp := 24
+	if hdr.AllowAlpha {
+		bpp = 32
+	}
+	if _, err := dst.Write(newHeader(size.X, size.Y, bpp, hdr.TopDown)); err != nil {
+		return err
+	}
+
+	pr := newPixelReader(src, hdr, region)
+	hr := newResampler(region.Dx(), size.X, filter)
+	out := make([]byte, byteWidth(size.X, bpp))
+	write := func(row []float32) error {
+		encodePixels(out, row, bpp)
+		_, err := dst.Write(out)
+		return err
+	}
+
+	// Both the input and output rows are traversed in file order. When the
+	// image is bottom-up, the vertical axis is flipped for both images, which
+	// is accounted for by the resampler.
+	vr := newResampler(region.Dy(), size.Y, filter)
+	if !hdr.TopDown {
+		vr.flip()
+	}
+	switch filter {
+	case Box:
+		acc := make([]float32, 4*size.X)
+		tmp := make([]float32, 4*size.X)
+		for i := 0; i < size.Y; i++ {
+			for j := range acc {
+				acc[j] = 0
+			}
+			lo, hi := vr.lo[i], vr.hi[i]
+			for s := lo; s < hi; s++ {
+				if err := pr.next(); err != nil {
+					return err
+				}
+				hr.resample(tmp, pr.pix)
+				for j := range acc {
+					acc[j] += tmp[j]
+				}
+			}
+			for j := range acc {
+				acc[j] /= float32(hi - lo)
+			}
+			if err := write(acc); err != nil {
+				return err
+			}
+		}
+	case Bilinear:
+		// Keep the two most recently read rows
+		rows := [2][]float32{make([]float32, 4*size.X), make([]float32, 4*size.X)}
+		row := make([]float32, 4*size.X)
+		read := -1
+		for i := 0; i < size.Y; i++ {
+			lo, hi := vr.lo[i], vr.hi[i]
+			for read < hi {
+				if err := pr.next(); err != nil {
+					return err
+				}
+				read++
+				if read < lo {
+					continue
+				}
+				rows[0], rows[1] = rows[1], rows[0]
+				hr.resample(rows[1], pr.pix)
+			}
+			a, b := rows[0], rows[1]
+			if lo == hi {
+				a = b
+			}
+			w := vr.w[i]
+			for j := range row {
+				row[j] = a[j]*(1-w) + b[j]*w
+			}
+			if err := write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resampler maps the pixels of one axis of the resized image to pixels of the
+// source image.
+//
+// For the box filter, pixel i is the average of source pixels [lo[i], hi[i]).
+// For the bilinear filter, pixel i is the source pixels lo[i] and hi[i]
+// weighted by 1-w[i] and w[i] respectively.
+type resampler struct {
+	filter Filter
+	n      int
+	lo, hi []int
+	w      []float32
+}
+
+func newResampler(from, to int, filter Filter) *resampler {
+	r := &resampler{
+		filter: filter,
+		n:      from,
+		lo:     make([]int, to),
+		hi:     make([]int, to),
+		w:      make([]float32, to),
+	}
+	for i := 0; i < to; i++ {
+		switch filter {
+		case Box:
+			r.lo[i] = i * from / to
+			r.hi[i] = (i + 1) * from / to
+		case Bilinear:
+			// Align pixel centers
+			s := (float64(i)+0.5)*float64(from)/float64(to) - 0.5
+			s = math.Max(0, math.Min(s, float64(from-1)))
+			lo := int(s)
+			r.lo[i] = lo
+			r.hi[i] = lo
+			if lo+1 < from {
+				r.hi[i] = lo + 1
+			}
+			r.w[i] = float32(s - float64(lo))
+		}
+	}
+	return r
+}
+
+// flip mirrors the mapping so that pixel i of the flipped axis is pixel
+// len-1-i of the original axis.
+func (r *resampler) flip() {
+	to := len(r.lo)
+	lo, hi, w := r.lo, r.hi, r.w
+	r.lo, r.hi, r.w = make([]int, to), make([]int, to), make([]float32, to)
+	for i := 0; i < to; i++ {
+		j := to - 1 - i
+		switch r.filter {
+		case Box:
+			r.lo[i] = r.n - hi[j]
+			r.hi[i] = r.n - lo[j]
+		case Bilinear:
+			r.lo[i] = r.n - 1 - hi[j]
+			r.hi[i] = r.n - 1 - lo[j]
+			r.w[i] = 1 - w[j]
+			if r.lo[i] == r.hi[i] {
+				r.w[i] = 0
+			}
+		}
+	}
+}
+
+// resample resamples a row of premultiplied RGBA pixels.
+func (r *resampler) resample(dst, src []float32) {
+	for i := range r.lo {
+		lo, hi := 4*r.lo[i], 4*r.hi[i]
+		switch r.filter {
+		case Box:
+			var c [4]float32
+			for j := lo; j < hi; j += 4 {
+				c[0] += src[j]
+				c[1] += src[j+1]
+				c[2] += src[j+2]
+				c[3] += src[j+3]
+			}
+			n := float32(r.hi[i] - r.lo[i])
+			for k := range c {
+				dst[4*i+k] = c[k] / n
+			}
+		case Bilinear:
+			w := r.w[i]
+			for k := 0; k < 4; k++ {
+				dst[4*i+k] = src[lo+k]*(1-w) + src[hi+k]*w
+			}
+		}
+	}
+}
+
+// pixelReader reads the rows of a region in file order and decodes them to
+// premultiplied RGBA pixels in the range [0, 255].
+type pixelReader struct {
+	src    io.Reader
+	hdr    DecodeResult
+	region image.Rectangle
+	seek   func(off int) (n int64, err error)
+	rle    *rleReader
+	raw    []byte
+	skip   int
+
+	palette color.Palette
+
+	// pix holds the pixels of the last read row
+	pix []float32
+}
+
+func newPixelReader(src io.Reader, hdr DecodeResult, region image.Rectangle) *pixelReader {
+	r := &pixelReader{
+		src:    src,
+		hdr:    hdr,
+		region: region,
+		seek:   ioutilx.Skipper(src),
+		pix:    make([]float32, 4*region.Dx()),
+	}
+	r.skip = hdr.Config.Height - region.Max.Y
+	if hdr.TopDown {
+		r.skip = region.Min.Y
+	}
+	if hdr.BitsPerPixel <= 8 {
+		r.palette = hdr.Config.ColorModel.(color.Palette)
+	}
+	if hdr.RLE {
+		r.rle = newRLEReader(src, hdr.BitsPerPixel, hdr.Config.Width)
+	} else {
+		r.raw = make([]byte, byteWidth(hdr.Config.Width, hdr.BitsPerPixel))
+	}
+	return r
+}
+
+// next reads and decodes the next row of the region.
+func (r *pixelReader) next() error {
+	if r.rle != nil {
+		for ; r.skip > 0; r.skip-- {
+			if err := r.rle.next(); err != nil {
+				return err
+			}
+		}
+		if err := r.rle.next(); err != nil {
+			return err
+		}
+	} else {
+		if r.skip > 0 {
+			if _, err := r.seek(r.skip * len(r.raw)); err != nil {
+				return err
+			}
+			r.skip = 0
+		}
+		if _, err := io.ReadFull(r.src, r.raw); err != nil {
+			return err
+		}
+	}
+
+	hdr := r.hdr
+	bpp := hdr.BitsPerPixel
+	for i, x := 0, r.region.Min.X; x < r.region.Max.X; i, x = i+4, x+1 {
+		var c [4]float32
+		switch {
+		case r.rle != nil:
+			c = paletteColor(r.palette, r.rle.row[x])
+		case bpp <= 8:
+			bit := x * bpp
+			idx := r.raw[bit/8] >> (8 - bpp - bit%8) & byte(1<<bpp-1)
+			c = paletteColor(r.palette, idx)
+		case bpp == 24:
+			b := r.raw[3*x:]
+			c = [4]float32{float32(b[2]), float32(b[1]), float32(b[0]), 255}
+		default:
+			var v uint32
+			if bpp == 16 {
+				v = uint32(binary.LittleEndian.Uint16(r.raw[2*x:]))
+			} else {
+				v = binary.LittleEndian.Uint32(r.raw[4*x:])
+			}
+			c[0] = channel(v, hdr.RedMask)
+			c[1] = channel(v, hdr.GreenMask)
+			c[2] = channel(v, hdr.BlueMask)
+			c[3] = 255
+			if hdr.AllowAlpha {
+				c[3] = channel(v, hdr.AlphaMask)
+			}
+		}
+
+		// Premultiply so that transparent pixels do not bleed color
+		a := c[3] / 255
+		r.pix[i] = c[0] * a
+		r.pix[i+1] = c[1] * a
+		r.pix[i+2] = c[2] * a
+		r.pix[i+3] = c[3]
+	}
+	return nil
+}
+
+func paletteColor(p color.Palette, idx byte) [4]float32 {
+	if int(idx) >= len(p) {
+		return [4]float32{0, 0, 0, 255}
+	}
+	r, g, b, _ := p[idx].RGBA()
+	return [4]float32{float32(r >> 8), float32(g >> 8), float32(b >> 8), 255}
+}
+
+// channel extracts the bits of v selected by mask, scaled to [0, 255].
+func channel(v, mask uint32) float32 {
+	if mask == 0 {
+		return 0
+	}
+	shift := 0
+	for mask>>shift&1 == 0 {
+		shift++
+	}
+	max := mask >> shift
+	return float32((v&mask)>>shift) * 255 / float32(max)
+}
+
+// encodePixels encodes a row of premultiplied RGBA pixels as BGR or BGRA.
+func encodePixels(dst []byte, pix []float32, bpp int) {
+	step := bpp / 8
+	for i, j := 0, 0; i < len(pix); i, j = i+4, j+step {
+		a := pix[i+3]
+		var r, g, b float32
+		if a > 0 {
+			r, g, b = pix[i]*255/a, pix[i+1]*255/a, pix[i+2]*255/a
+		}
+		dst[j] = clampByte(b)
+		dst[j+1] = clampByte(g)
+		dst[j+2] = clampByte(r)
+		if step == 4 {
+			dst[j+3] = clampByte(a)
+		}
+	}
+}
+
+func clampByte(v float32) byte {
+	v = float32(math.Round(float64(v)))
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return byte(v)
+}
+
+// newHeader returns the header of an uncompressed BMP with 24 or 32 bits per
+// pixel. Images with 32 bits per pixel have a BITMAPV4HEADER with an alpha
+// mask.
+func newHeader(width, height, bpp int, topDown bool) []byte {
+	infoLen := infoHeaderLen
+	if bpp == 32 {
+		infoLen = v4InfoHeaderLen
+	}
+	imageSize := byteWidth(width, bpp) * height
+	b := make([]byte, fileHeaderLen+infoLen)
+	if topDown {
+		height = -height
+	}
+	le := binary.LittleEndian
+	copy(b, "BM")
+	le.PutUint32(b[2:6], uint32(len(b)+imageSize))
+	le.PutUint32(b[10:14], uint32(len(b)))
+	le.PutUint32(b[14:18], uint32(infoLen))
+	le.PutUint32(b[18:22], uint32(width))
+	le.PutUint32(b[22:26], uint32(int32(height)))
+	le.PutUint16(b[26:28], 1)
+	le.PutUint16(b[28:30], uint16(bpp))
+	le.PutUint32(b[34:38], uint32(imageSize))
+	if bpp == 32 {
+		le.PutUint32(b[30:34], compressionBitfields)
+		le.PutUint32(b[54:58], 0xff0000)
+		le.PutUint32(b[58:62], 0xff00)
+		le.PutUint32(b[62:66], 0xff)
+		le.PutUint32(b[66:70], 0xff000000)
+		le.PutUint32(b[70:74], 0x73524742) // 'sRGB'
+	}
+	return b
+}
@@ -0,0 +1,179 @@
+package bmpx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestResizeBox(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		f := image.Pt(1+rand.Intn(4), 1+rand.Intn(4))
+		size := image.Pt(1+rand.Intn(50), 1+rand.Intn(50))
+		img := randRGBA(size.X*f.X, size.Y*f.Y)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, img))
+		src := withInfoHeader(t, b.Bytes(), v4InfoHeaderLen, nil)
+		if i%2 == 1 {
+			src = toTopDown(t, src)
+		}
+		var resized bytes.Buffer
+		err := Resize(bytes.NewReader(src), &resized, size, Box)
+		require.NoError(t, err)
+		got, err := bmp.Decode(&resized)
+		require.NoError(t, err)
+
+		want := refResize(img, img.Bounds(), size, func(x, y float64) color.Color {
+			var r, g, b, a float64
+			for sy := int(y) * f.Y; sy < (int(y)+1)*f.Y; sy++ {
+				for sx := int(x) * f.X; sx < (int(x)+1)*f.X; sx++ {
+					c := img.NRGBAAt(sx, sy)
+					r += float64(c.R) * float64(c.A)
+					g += float64(c.G) * float64(c.A)
+					b += float64(c.B) * float64(c.A)
+					a += float64(c.A)
+				}
+			}
+			return unpremultiply(r, g, b, a, float64(f.X*f.Y))
+		})
+		requireImageNear(t, want, got)
+	}
+}
+
+func TestResizeBilinear(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		w := 1 + rand.Intn(100)
+		h := 1 + rand.Intn(100)
+		img := randRGB(w, h)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, img))
+		src := b.Bytes()
+		if i%2 == 1 {
+			src = toTopDown(t, src)
+		}
+		region := randRegion(w, h)
+		size := image.Pt(1+rand.Intn(150), 1+rand.Intn(150))
+		var resized bytes.Buffer
+		err := CropResize(bytes.NewReader(src), &resized, region, size, Bilinear)
+		require.NoError(t, err)
+		got, err := bmp.Decode(&resized)
+		require.NoError(t, err)
+
+		at := func(x, y int) [3]float64 {
+			x = clampInt(x, 0, region.Dx()-1)
+			y = clampInt(y, 0, region.Dy()-1)
+			c := img.RGBAAt(region.Min.X+x, region.Min.Y+y)
+			return [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+		}
+		want := refResize(img, region, size, func(x, y float64) color.Color {
+			sx := math.Max(0, (x+0.5)*float64(region.Dx())/float64(size.X)-0.5)
+			sy := math.Max(0, (y+0.5)*float64(region.Dy())/float64(size.Y)-0.5)
+			x0, y0 := int(sx), int(sy)
+			wx, wy := sx-float64(x0), sy-float64(y0)
+			var c [3]float64
+			for k := range c {
+				top := at(x0, y0)[k]*(1-wx) + at(x0+1, y0)[k]*wx
+				bottom := at(x0, y0+1)[k]*(1-wx) + at(x0+1, y0+1)[k]*wx
+				c[k] = top*(1-wy) + bottom*wy
+			}
+			return unpremultiply(c[0]*255, c[1]*255, c[2]*255, 255, 1)
+		})
+		requireImageNear(t, want, got)
+	}
+}
+
+func TestResizeIdentity(t *testing.T) {
+	img := randRGB(37, 23)
+	var b bytes.Buffer
+	require.NoError(t, bmp.Encode(&b, img))
+	for _, filter := range []Filter{Box, Bilinear} {
+		var resized bytes.Buffer
+		err := Resize(bytes.NewReader(b.Bytes()), &resized, image.Pt(37, 23), filter)
+		require.NoError(t, err)
+		require.Equal(t, b.Bytes(), resized.Bytes())
+	}
+}
+
+func TestResizeRLE(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := 1 + rand.Intn(100)
+		h := 1 + rand.Intn(100)
+		img := randRuns(w, h, 8)
+		region := randRegion(w, h)
+		size := image.Pt(1+rand.Intn(region.Dx()), 1+rand.Intn(region.Dy()))
+		var want, got bytes.Buffer
+		err := CropResize(bytes.NewReader(encodePaletted(t, img, 8)), &want, region, size, Box)
+		require.NoError(t, err)
+		err = CropResize(bytes.NewReader(encodeRLE(t, img, 8)), &got, region, size, Box)
+		require.NoError(t, err)
+		require.Equal(t, want.Bytes(), got.Bytes())
+	}
+}
+
+func TestResizeBoxUpscale(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, bmp.Encode(&b, randRGB(10, 10)))
+	err := Resize(&b, &bytes.Buffer{}, image.Pt(20, 5), Box)
+	require.Error(t, err)
+}
+
+// refResize resizes the region of img in memory, computing each pixel with at.
+func refResize(img image.Image, region image.Rectangle, size image.Point, at func(x, y float64) color.Color) image.Image {
+	res := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			res.Set(x, y, at(float64(x), float64(y)))
+		}
+	}
+	return res
+}
+
+// unpremultiply returns the average of n premultiplied colors, where r, g and
+// b are premultiplied by an alpha in [0, 255].
+func unpremultiply(r, g, b, a, n float64) color.NRGBA {
+	if a == 0 {
+		return color.NRGBA{}
+	}
+	return color.NRGBA{
+		R: uint8(math.Round(r / a)),
+		G: uint8(math.Round(g / a)),
+		B: uint8(math.Round(b / a)),
+		A: uint8(math.Round(a / n)),
+	}
+}
+
+// requireImageNear requires the non-premultiplied colors of the images to
+// differ by at most one due to rounding.
+func requireImageNear(t *testing.T, want, got image.Image) {
+	require.Equal(t, want.Bounds(), got.Bounds())
+	for y := want.Bounds().Min.Y; y < want.Bounds().Max.Y; y++ {
+		for x := want.Bounds().Min.X; x < want.Bounds().Max.X; x++ {
+			w := color.NRGBAModel.Convert(want.At(x, y)).(color.NRGBA)
+			g := color.NRGBAModel.Convert(got.At(x, y)).(color.NRGBA)
+			if w.A == 0 && g.A == 0 {
+				continue
+			}
+			for k, d := range []int{
+				int(w.R) - int(g.R), int(w.G) - int(g.G), int(w.B) - int(g.B), int(w.A) - int(g.A),
+			} {
+				require.LessOrEqual(t, d*d, 1, "(%v,%v) channel %v: want %v, got %v", x, y, k, w, g)
+			}
+		}
+	}
+}
+
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
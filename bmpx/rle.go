@@ -0,0 +1,322 @@
+package bmpx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+)
+
+// errRLEProfile is returned for RLE compressed images with an ICC profile after
+// the pixel data, since the end of the compressed pixels is not known until
+// they have all been decoded.
+var errRLEProfile = errors.New("unsupported: RLE compressed image with a trailing ICC profile")
+
+// cropRLE crops the region of an RLE8 or RLE4 compressed image whose header
+// has already been read from src.
+//
+// Compressed rows can not be skipped by seeking, so rows are decoded one at a
+// time until the last row of the region. If rle is set, the cropped rows are
+// encoded with the compression of the input, otherwise the cropped image is
+// uncompressed.
+func cropRLE(src io.Reader, dst io.Writer, hdr DecodeResult, region image.Rectangle, rle bool) error {
+	if hdr.trailingProfile() {
+		return errRLEProfile
+	}
+	width, height := region.Dx(), region.Dy()
+
+	var ws io.WriteSeeker
+	var start int64
+	if rle {
+		// The size of the pixel data is not known until it has been encoded, so
+		// the header is updated afterwards.
+		var ok bool
+		ws, ok = dst.(io.WriteSeeker)
+		if !ok {
+			return errors.New("bmp: RLE output requires an io.WriteSeeker")
+		}
+		var err error
+		start, err = ws.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+	} else {
+		binary.LittleEndian.PutUint32(hdr.HeaderBytes[30:34], compressionNone)
+	}
+	if err := writeHeader(dst, hdr, width, height); err != nil {
+		return err
+	}
+
+	// RLE images are always bottom-up, skip rows below the region
+	dec := newRLEReader(src, hdr.BitsPerPixel, hdr.Config.Width)
+	for i := 0; i < hdr.Config.Height-region.Max.Y; i++ {
+		if err := dec.next(); err != nil {
+			return err
+		}
+	}
+
+	var out []byte
+	if rle {
+		out = make([]byte, 0, 2*width+4)
+	} else {
+		out = make([]byte, byteWidth(width, hdr.BitsPerPixel))
+	}
+	var imageSize int
+	for dy := 1; dy <= height; dy++ {
+		if err := dec.next(); err != nil {
+			return err
+		}
+		row := dec.row[region.Min.X:region.Max.X]
+		if rle {
+			out = appendRLE(out[:0], row, hdr.BitsPerPixel, dy == height)
+		} else {
+			packRow(out, row, hdr.BitsPerPixel)
+		}
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		imageSize += len(out)
+	}
+	if !rle {
+		return nil
+	}
+
+	// Patch file and image size
+	end, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	var b [8]byte
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(hdr.HeaderBytes)+imageSize))
+	binary.LittleEndian.PutUint32(b[4:], uint32(imageSize))
+	for _, field := range []struct {
+		off int64
+		b   []byte
+	}{
+		{2, b[:4]},
+		{34, b[4:]},
+	} {
+		if _, err := ws.Seek(start+field.off, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := ws.Write(field.b); err != nil {
+			return err
+		}
+	}
+	_, err = ws.Seek(end, io.SeekStart)
+	return err
+}
+
+// packRow packs one pixel index per byte into dst with bpp bits per pixel.
+// Padding bytes at the end of dst are cleared.
+func packRow(dst, row []byte, bpp int) {
+	if bpp == 8 {
+		n := copy(dst, row)
+		for i := n; i < len(dst); i++ {
+			dst[i] = 0
+		}
+		return
+	}
+	for i := range dst {
+		dst[i] = 0
+	}
+	for x, idx := range row {
+		bit := x * bpp
+		dst[bit/8] |= idx << (8 - bpp - bit%8)
+	}
+}
+
+// rleReader decodes RLE8 and RLE4 compressed pixel data one row at a time.
+type rleReader struct {
+	r   io.ByteReader
+	bpp int
+
+	// row holds the pixel indices of the last decoded row, one byte per pixel
+	row []byte
+
+	// Decoding state carried over to subsequent rows by delta and end of
+	// bitmap escapes.
+	x     int
+	blank int
+	eob   bool
+}
+
+func newRLEReader(r io.Reader, bpp, width int) *rleReader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &rleReader{r: br, bpp: bpp, row: make([]byte, width)}
+}
+
+// next decodes the next row in file order. Pixels that are skipped by delta or
+// end of bitmap escapes are set to zero.
+func (d *rleReader) next() error {
+	for i := range d.row {
+		d.row[i] = 0
+	}
+	if d.blank > 0 {
+		d.blank--
+		return nil
+	}
+	if d.eob {
+		return nil
+	}
+	set := func(x int, idx byte) {
+		if x < len(d.row) {
+			d.row[x] = idx
+		}
+	}
+	x := d.x
+	d.x = 0
+	for {
+		n, err := d.readByte()
+		if err != nil {
+			return err
+		}
+		v, err := d.readByte()
+		if err != nil {
+			return err
+		}
+
+		// Encoded mode: n pixels with the value v. For RLE4, the pixels
+		// alternate between the high and low nibble of v.
+		if n > 0 {
+			for i := 0; i < int(n); i++ {
+				idx := v
+				if d.bpp == 4 {
+					idx = v >> 4
+					if i%2 == 1 {
+						idx = v & 0xf
+					}
+				}
+				set(x, idx)
+				x++
+			}
+			continue
+		}
+
+		// Escapes
+		switch v {
+		case 0: // End of line
+			return nil
+		case 1: // End of bitmap
+			d.eob = true
+			return nil
+		case 2: // Delta
+			dx, err := d.readByte()
+			if err != nil {
+				return err
+			}
+			dy, err := d.readByte()
+			if err != nil {
+				return err
+			}
+			x += int(dx)
+			if dy > 0 {
+				d.blank = int(dy) - 1
+				d.x = x
+				return nil
+			}
+		default: // Absolute mode: v literal pixels, padded to a 16-bit boundary
+			nbytes := int(v)
+			if d.bpp == 4 {
+				nbytes = (nbytes + 1) / 2
+			}
+			for i := 0; i < nbytes; i++ {
+				b, err := d.readByte()
+				if err != nil {
+					return err
+				}
+				if d.bpp == 8 {
+					set(x, b)
+					x++
+					continue
+				}
+				set(x, b>>4)
+				x++
+				if 2*i+1 < int(v) {
+					set(x, b&0xf)
+					x++
+				}
+			}
+			if nbytes%2 == 1 {
+				if _, err := d.readByte(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (d *rleReader) readByte() (byte, error) {
+	b, err := d.r.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return b, err
+}
+
+// appendRLE appends the RLE8 or RLE4 encoding of a row of pixel indices to b,
+// followed by an end of line escape, or end of bitmap when last is set.
+//
+// Runs of at least three equal pixels are encoded, other pixels are written in
+// absolute mode. Absolute mode requires at least three pixels, shorter
+// sequences are encoded as runs of one pixel instead.
+func appendRLE(b, row []byte, bpp int, last bool) []byte {
+	const maxRun = 255
+	runLen := func(i int) int {
+		n := 1
+		for i+n < len(row) && n < maxRun && row[i+n] == row[i] {
+			n++
+		}
+		return n
+	}
+	appendRun := func(b []byte, idx byte, n int) []byte {
+		if bpp == 4 {
+			idx = idx<<4 | idx
+		}
+		return append(b, byte(n), idx)
+	}
+	for i := 0; i < len(row); {
+		if n := runLen(i); n >= 3 {
+			b = appendRun(b, row[i], n)
+			i += n
+			continue
+		}
+
+		// Collect literal pixels until the next run of three
+		j := i
+		for j < len(row) && j-i < maxRun && runLen(j) < 3 {
+			j++
+		}
+		if j-i < 3 {
+			for ; i < j; i++ {
+				b = appendRun(b, row[i], 1)
+			}
+			continue
+		}
+		b = append(b, 0, byte(j-i))
+		start := len(b)
+		if bpp == 8 {
+			b = append(b, row[i:j]...)
+		} else {
+			for k := i; k < j; k += 2 {
+				v := row[k] << 4
+				if k+1 < j {
+					v |= row[k+1]
+				}
+				b = append(b, v)
+			}
+		}
+		if (len(b)-start)%2 == 1 {
+			b = append(b, 0)
+		}
+		i = j
+	}
+	if last {
+		return append(b, 0, 1)
+	}
+	return append(b, 0, 0)
+}
@@ -0,0 +1,178 @@
+package bmpx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCropRLE(t *testing.T) {
+	for _, bpp := range []int{4, 8} {
+		for i := 0; i < 50; i++ {
+			w := 1 + rand.Intn(300)
+			h := 1 + rand.Intn(100)
+			img := randRuns(w, h, bpp)
+			src := encodeRLE(t, img, bpp)
+			region := randRegion(w, h)
+			sub := img.SubImage(region).(*image.Paletted)
+
+			// Uncompressed output
+			var cropped bytes.Buffer
+			err := Crop(bytes.NewReader(src), &cropped, region)
+			require.NoError(t, err)
+			require.Equal(t, encodePaletted(t, sub, bpp), cropped.Bytes(), "%v bpp, region %v", bpp, region)
+
+			// RLE output
+			f, err := os.Create(filepath.Join(t.TempDir(), "cropped.bmp"))
+			require.NoError(t, err)
+			err = CropWithOptions(bytes.NewReader(src), f, region, &Options{RLE: true})
+			require.NoError(t, err)
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			got, err := io.ReadAll(f)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+			require.Equal(t, encodeRLE(t, sub, bpp), got, "%v bpp, region %v", bpp, region)
+		}
+	}
+}
+
+func TestCropRLEOutputRequiresSeeker(t *testing.T) {
+	img := randRuns(10, 10, 8)
+	src := encodeRLE(t, img, 8)
+	var cropped bytes.Buffer
+	err := CropWithOptions(bytes.NewReader(src), &cropped, image.Rect(0, 0, 5, 5), &Options{RLE: true})
+	require.Error(t, err)
+}
+
+func TestCropRLEProfile(t *testing.T) {
+	src := withRLEProfile(t, encodeRLE(t, randRuns(10, 10, 8), 8), []byte("profile"))
+	hdr, err := DecodeHeader(bytes.NewReader(src))
+	require.NoError(t, err)
+	require.True(t, hdr.RLE)
+	require.True(t, hdr.trailingProfile())
+
+	// Compressed images with a trailing profile are rejected by all croppers
+	region := image.Rect(2, 2, 8, 8)
+	f, err := os.Create(filepath.Join(t.TempDir(), "cropped.bmp"))
+	require.NoError(t, err)
+	defer f.Close()
+	err = CropWithOptions(bytes.NewReader(src), f, region, &Options{RLE: true})
+	require.Equal(t, errRLEProfile, err)
+	err = Crop(bytes.NewReader(src), io.Discard, region)
+	require.Equal(t, errRLEProfile, err)
+	err = CropMany(bytes.NewReader(src), []image.Rectangle{region}, []io.Writer{io.Discard})
+	require.Equal(t, errRLEProfile, err)
+	err = Tile(bytes.NewReader(src), image.Pt(5, 5), 0, func(x, y int, region image.Rectangle) (io.WriteCloser, error) {
+		return &nopCloser{}, nil
+	})
+	require.Equal(t, errRLEProfile, err)
+}
+
+func TestRLEReader(t *testing.T) {
+	// A 6x4 RLE8 image, from the bottom row and up:
+	// - a run of 3 pixels followed by 3 literal pixels
+	// - a delta moving 2 pixels right and 2 rows up
+	// - a run of 2 pixels, then end of bitmap
+	data := []byte{
+		3, 7, 0, 3, 1, 2, 3, 0, 0, 0,
+		0, 2, 2, 2,
+		2, 9, 0, 1,
+	}
+	dec := newRLEReader(bytes.NewReader(data), 8, 6)
+	for _, want := range [][]byte{
+		{7, 7, 7, 1, 2, 3},
+		{0, 0, 0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0},
+		{0, 0, 9, 9, 0, 0},
+	} {
+		require.NoError(t, dec.next())
+		require.Equal(t, want, dec.row)
+	}
+
+	// RLE4 runs alternate between nibbles, literals are padded to 16 bits
+	data = []byte{5, 0x12, 0, 3, 0x34, 0x50, 0, 1}
+	dec = newRLEReader(bytes.NewReader(data), 4, 8)
+	require.NoError(t, dec.next())
+	require.Equal(t, []byte{1, 2, 1, 2, 1, 3, 4, 5}, dec.row)
+}
+
+// encodeRLE encodes img as an RLE8 or RLE4 compressed BMP.
+func encodeRLE(t *testing.T, img *image.Paletted, bpp int) []byte {
+	b := encodePaletted(t, img, bpp)
+	hdr, err := DecodeHeader(bytes.NewReader(b))
+	require.NoError(t, err)
+	res := append([]byte{}, b[:hdr.ImageOffset]...)
+	h := img.Rect.Dy()
+	row := make([]byte, img.Rect.Dx())
+	for y := h - 1; y >= 0; y-- {
+		for x := range row {
+			row[x] = img.ColorIndexAt(img.Rect.Min.X+x, img.Rect.Min.Y+y)
+		}
+		res = appendRLE(res, row, bpp, y == 0)
+	}
+	compression := uint32(compressionRLE8)
+	if bpp == 4 {
+		compression = compressionRLE4
+	}
+	le := binary.LittleEndian
+	le.PutUint32(res[2:6], uint32(len(res)))
+	le.PutUint32(res[30:34], compression)
+	le.PutUint32(res[34:38], uint32(len(res)-int(hdr.ImageOffset)))
+	return res
+}
+
+// randRuns returns a random paletted image whose rows mix runs of equal pixels
+// with random pixels.
+func randRuns(w, h, bpp int) *image.Paletted {
+	palette := make(color.Palette, 1<<bpp)
+	for i := range palette {
+		palette[i] = color.RGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), 0xff}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	for i := 0; i < len(img.Pix); {
+		n := 1 + rand.Intn(10)
+		if rand.Intn(2) == 0 {
+			n = 1 + rand.Intn(300)
+		}
+		idx := uint8(rand.Intn(len(palette)))
+		for j := 0; j < n && i < len(img.Pix); j++ {
+			if n < 10 {
+				idx = uint8(rand.Intn(len(palette)))
+			}
+			img.Pix[i] = idx
+			i++
+		}
+	}
+	return img
+}
+
+// withRLEProfile returns the RLE compressed BMP b with a BITMAPV5HEADER and
+// the provided ICC profile after the pixel data.
+func withRLEProfile(t *testing.T, b, profile []byte) []byte {
+	hdr, err := DecodeHeader(bytes.NewReader(b))
+	require.NoError(t, err)
+	extra := v5InfoHeaderLen - infoHeaderLen
+	offset := int(hdr.ImageOffset) + extra
+	res := make([]byte, 0, len(b)+extra+len(profile))
+	res = append(res, b[:fileHeaderLen+infoHeaderLen]...)
+	res = append(res, make([]byte, extra)...)
+	res = append(res, b[fileHeaderLen+infoHeaderLen:]...)
+	res = append(res, profile...)
+	le := binary.LittleEndian
+	le.PutUint32(res[2:6], uint32(len(res)))
+	le.PutUint32(res[10:14], uint32(offset))
+	le.PutUint32(res[14:18], v5InfoHeaderLen)
+	le.PutUint32(res[70:74], profileEmbedded)
+	le.PutUint32(res[126:130], uint32(len(b)+extra-fileHeaderLen))
+	le.PutUint32(res[130:134], uint32(len(profile)))
+	return res
+}
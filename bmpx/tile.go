@@ -0,0 +1,81 @@
+package bmpx
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// Tile splits the BMP found in the input stream into a grid of tiles of the
+// provided size, where adjacent tiles overlap by the provided number of pixels.
+// Tiles in the last row and column are cut off by the edge of the image, and
+// may therefore be smaller.
+//
+// For each tile, create is called with the column and row index of the tile in
+// the grid, and its region of the image. Tiles are written in the same format
+// as by Crop. The returned writer is closed once all rows of the tile have been
+// written.
+//
+// Like CropMany, the input is read once from start to end. Outputs are created
+// right before the first row of a tile is read and closed after its last row,
+// so the tiles of every row of the grid that covers the current row of the
+// image are open at the same time. Without overlap that is one row of tiles,
+// otherwise it is up to ceil(size.Y / (size.Y - overlap)) rows.
+func Tile(src io.Reader, size image.Point, overlap int, create func(x, y int, region image.Rectangle) (io.WriteCloser, error)) error {
+	if size.X <= 0 || size.Y <= 0 {
+		return errors.New("tile size must be positive")
+	}
+	if overlap < 0 || overlap >= size.X || overlap >= size.Y {
+		return errors.New("tile overlap must be non-negative and less than the tile size")
+	}
+
+	hdr, err := DecodeHeader(src)
+	if err != nil {
+		return err
+	}
+
+	// Create targets that keep track of open outputs, so that they can be
+	// closed should cropping fail
+	open := make(map[*cropTarget]io.Closer)
+	var targets []*cropTarget
+	xs := tileStarts(hdr.Config.Width, size.X, size.X-overlap)
+	ys := tileStarts(hdr.Config.Height, size.Y, size.Y-overlap)
+	for j, y := range ys {
+		for i, x := range xs {
+			i, j := i, j
+			t := &cropTarget{region: image.Rect(x, y, x+size.X, y+size.Y)}
+			t.open = func() (io.Writer, error) {
+				w, err := create(i, j, t.region)
+				if err != nil {
+					return nil, err
+				}
+				open[t] = w
+				return w, nil
+			}
+			t.close = func() error {
+				c := open[t]
+				delete(open, t)
+				return c.Close()
+			}
+			targets = append(targets, t)
+		}
+	}
+
+	err = scan(src, hdr, targets)
+	for _, c := range open {
+		c.Close()
+	}
+	return err
+}
+
+// tileStarts returns the offsets of tiles with the provided size and stride
+// along an axis of length n. The last tile ends at or beyond n.
+func tileStarts(n, size, stride int) []int {
+	var res []int
+	for x := 0; ; x += stride {
+		res = append(res, x)
+		if x+size >= n {
+			return res
+		}
+	}
+}
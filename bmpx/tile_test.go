@@ -0,0 +1,74 @@
+package bmpx
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+type nopCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *nopCloser) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTile(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+		src := b.Bytes()
+		size := image.Pt(8+rand.Intn(64), 8+rand.Intn(64))
+		overlap := rand.Intn(size.X)
+		if size.Y < size.X {
+			overlap = rand.Intn(size.Y)
+		}
+
+		tiles := make(map[image.Point]*nopCloser)
+		regions := make(map[image.Point]image.Rectangle)
+		err := Tile(bytes.NewReader(src), size, overlap, func(x, y int, region image.Rectangle) (io.WriteCloser, error) {
+			p := image.Pt(x, y)
+			require.NotContains(t, tiles, p)
+			tiles[p] = &nopCloser{}
+			regions[p] = region
+			return tiles[p], nil
+		})
+		require.NoError(t, err)
+
+		// The grid covers the image
+		nx := len(tileStarts(w, size.X, size.X-overlap))
+		ny := len(tileStarts(h, size.Y, size.Y-overlap))
+		require.Len(t, tiles, nx*ny)
+		require.Equal(t, w, regions[image.Pt(nx-1, 0)].Max.X)
+		require.Equal(t, h, regions[image.Pt(0, ny-1)].Max.Y)
+		for p, tile := range tiles {
+			region := regions[p]
+			require.Equal(t, image.Pt(p.X*(size.X-overlap), p.Y*(size.Y-overlap)), region.Min)
+			require.True(t, tile.closed)
+			var want bytes.Buffer
+			err := Crop(bytes.NewReader(src), &want, region)
+			require.NoError(t, err)
+			require.Equal(t, want.Bytes(), tile.Bytes(), "tile %v", p)
+		}
+	}
+}
+
+func TestTileInvalidOverlap(t *testing.T) {
+	var b bytes.Buffer
+	require.NoError(t, bmp.Encode(&b, randRGB(10, 10)))
+	create := func(x, y int, region image.Rectangle) (io.WriteCloser, error) {
+		return &nopCloser{}, nil
+	}
+	err := Tile(&b, image.Pt(4, 4), 4, create)
+	require.Error(t, err)
+}
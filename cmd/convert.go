@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/sebnyberg/imgcrop/internal/exp/tiffx"
+	"github.com/sebnyberg/imgcrop/pngx"
+	"golang.org/x/image/bmp"
+)
+
+const convertUsage = `usage: imgcrop convert [flags] [src] [dst]
+
+Converts an image to the format given by -format, or by the extension of dst.
+src and dst default to stdin and stdout. Writing to stdout requires -format.
+
+TIFF images are written in the strict, crop-friendly profile of tiffx.
+
+BMP to BMP conversion is streamed, and writes RLE compressed images
+uncompressed. TIFF to TIFF conversion of files reads one strip at a time. PNG to
+BMP and PNG to TIFF conversion decodes one row at a time.
+Other conversions decode the entire image into memory.
+
+Flags:
+`
+
+func convertCmd(args []string) error {
+	fs := newFlagSet("convert", convertUsage)
+	format := fs.String("format", "", "output format, one of bmp, png, tiff or jpeg")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	srcPath, dstPath, err := inputOutput(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *format == "" && dstPath != "-" {
+		ext := filepath.Ext(strings.TrimSuffix(dstPath, ".zst"))
+		*format = strings.TrimPrefix(strings.ToLower(ext), ".")
+	}
+	encode, err := encoder(*format)
+	if err != nil {
+		return err
+	}
+
+	src, err := openInput(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createOutput(dstPath)
+	if err != nil {
+		return err
+	}
+	return dst.close(convert(src, dst, *format, encode))
+}
+
+// convert converts the image in src to the provided format.
+func convert(src io.Reader, dst io.Writer, format string, encode func(io.Writer, image.Image) error) error {
+	src, srcFormat, dec, err := sniff(src)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	switch {
+	case srcFormat == "bmp" && format == "bmp":
+		return bmpx.Crop(src, dst, image.Rect(0, 0, math.MaxInt32, math.MaxInt32))
+	case srcFormat == "tiff" && (format == "tif" || format == "tiff"):
+		// TIFF files are converted by reading strips at their offsets
+		if f, ok := src.(io.ReaderAt); ok {
+			return tiffx.Convert(f, dst)
+		}
+	case srcFormat == "png" && format == "bmp":
+		return pngx.CropWithOptions(src, dst, image.Rect(0, 0, math.MaxInt32, math.MaxInt32), &pngx.Options{Format: pngx.BMP})
+	case srcFormat == "png" && (format == "tif" || format == "tiff"):
+		return pngx.CropWithOptions(src, dst, image.Rect(0, 0, math.MaxInt32, math.MaxInt32), &pngx.Options{Format: pngx.TIFF})
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return err
+	}
+	return encode(dst, img)
+}
+
+// encoder returns the image encoder of the provided format.
+func encoder(format string) (func(io.Writer, image.Image) error, error) {
+	switch format {
+	case "bmp":
+		return bmp.Encode, nil
+	case "png":
+		return png.Encode, nil
+	case "tif", "tiff":
+		return tiffx.Encode, nil
+	case "jpg", "jpeg":
+		return func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, nil)
+		}, nil
+	case "":
+		return nil, usageError{errors.New("output format is required when writing to stdout")}
+	}
+	return nil, usageError{fmt.Errorf("unsupported output format %q", format)}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/sebnyberg/imgcrop/internal/exp/tiffx"
+	"github.com/sebnyberg/imgcrop/pngx"
+)
+
+const cropUsage = `usage: imgcrop crop [flags] <x,y,w,h> [src] [dst]
+
+Crops the region of w by h pixels at offset x,y from the top-left corner of src
+to dst. The region is cut off by the edges of the image. src and dst default to
+stdin and stdout.
+
+src may be a BMP, TIFF or PNG image, and the cropped image has the same format.
+TIFF files may be any baseline TIFF, while TIFF read from stdin must be in the
+strict profile of tiffx. PNG images are decoded up to the last row of the
+region.
+
+src may be compressed with zstd. Files in the zstd seekable format are cropped
+like uncompressed files, other streams are decompressed as they are read. dst
+is compressed with zstd if its name ends with .zst.
+
+Flags:
+`
+
+func cropCmd(args []string) error {
+	fs := newFlagSet("crop", cropUsage)
+	rle := fs.Bool("rle", false, "keep RLE compression of the input, requires dst to be an uncompressed file")
+	resize := fs.String("resize", "", "resize the cropped region to `WxH` pixels")
+	filter := fs.String("filter", "bilinear", "resize filter, box or bilinear")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return usageError{errors.New("expected a region")}
+	}
+	region, err := parseRegion(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	srcPath, dstPath, err := inputOutput(fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	var size image.Point
+	var f bmpx.Filter
+	if *resize != "" {
+		if *rle {
+			return usageError{errors.New("-rle can not be combined with -resize")}
+		}
+		if size, err = parseSize(*resize); err != nil {
+			return err
+		}
+		if f, err = parseFilter(*filter); err != nil {
+			return err
+		}
+	}
+	if *rle && (dstPath == "-" || strings.HasSuffix(dstPath, ".zst")) {
+		return usageError{errors.New("-rle requires dst to be an uncompressed file")}
+	}
+
+	in, err := openInput(srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	src, format, dec, err := sniff(in)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	if (format == "tiff" || format == "png") && (*rle || *resize != "") {
+		return usageError{errors.New("-rle and -resize are only supported for BMP images")}
+	}
+	dst, err := createOutput(dstPath)
+	if err != nil {
+		return err
+	}
+	switch {
+	case format == "tiff":
+		// Files may be any baseline TIFF, streams must be in the strict profile
+		if file, ok := src.(io.ReaderAt); ok {
+			err = tiffx.CropAt(file, dst, region)
+		} else {
+			err = tiffx.Crop(src, dst, region)
+		}
+	case format == "png":
+		err = pngx.Crop(src, dst, region)
+	case *resize != "":
+		err = bmpx.CropResize(src, dst, region, size, f)
+	case *rle:
+		// The header of RLE output is updated after the pixels, which needs
+		// the file itself
+		err = bmpx.CropWithOptions(src, dst.f, region, &bmpx.Options{RLE: true})
+	default:
+		err = bmpx.Crop(src, dst, region)
+	}
+	return dst.close(err)
+}
+
+// parseFilter parses the name of a resize filter.
+func parseFilter(s string) (bmpx.Filter, error) {
+	switch s {
+	case "box":
+		return bmpx.Box, nil
+	case "bilinear":
+		return bmpx.Bilinear, nil
+	}
+	return 0, usageError{fmt.Errorf("invalid filter %q, expected box or bilinear", s)}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/sebnyberg/imgcrop/internal/exp/tiffx"
+	_ "golang.org/x/image/tiff"
+)
+
+const infoUsage = `usage: imgcrop info [src]
+
+Prints the header of an image. src defaults to stdin.
+
+BMP headers are printed in full. For other formats, only the format and size of
+the image is printed, and for TIFF files the number of pages.
+`
+
+func infoCmd(args []string) error {
+	fs := newFlagSet("info", infoUsage)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return usageError{fmt.Errorf("too many arguments")}
+	}
+	srcPath := "-"
+	if fs.NArg() == 1 {
+		srcPath = fs.Arg(0)
+	}
+	src, err := openInput(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	r, format, dec, err := sniff(src)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	switch format {
+	case "bmp":
+		hdr, err := bmpx.DecodeHeader(r)
+		if err != nil {
+			return err
+		}
+		printBMPInfo(w, hdr)
+		return w.Flush()
+	case "tiff":
+		// The IFD is commonly at the end of the file, which image.DecodeConfig
+		// would read into memory to get to
+		if f, ok := r.(io.ReaderAt); ok {
+			pages, err := tiffx.Pages(f)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "format:\ttiff\n")
+			fmt.Fprintf(w, "width:\t%d\n", pages[0].Width)
+			fmt.Fprintf(w, "height:\t%d\n", pages[0].Height)
+			fmt.Fprintf(w, "pages:\t%d\n", len(pages))
+			return w.Flush()
+		}
+	}
+	cfg, format, err := image.DecodeConfig(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "format:\t%s\n", format)
+	fmt.Fprintf(w, "width:\t%d\n", cfg.Width)
+	fmt.Fprintf(w, "height:\t%d\n", cfg.Height)
+	return w.Flush()
+}
+
+// printBMPInfo prints the fields of a BMP header to w.
+func printBMPInfo(w io.Writer, hdr bmpx.DecodeResult) {
+	le := binary.LittleEndian
+	compression := le.Uint32(hdr.HeaderBytes[30:34])
+	names := []string{"none", "rle8", "rle4", "bitfields"}
+	compressionName := fmt.Sprint(compression)
+	if int(compression) < len(names) {
+		compressionName = names[compression]
+	}
+	orientation := "bottom-up"
+	if hdr.TopDown {
+		orientation = "top-down"
+	}
+
+	fmt.Fprintf(w, "format:\tbmp\n")
+	fmt.Fprintf(w, "width:\t%d\n", hdr.Config.Width)
+	fmt.Fprintf(w, "height:\t%d\n", hdr.Config.Height)
+	fmt.Fprintf(w, "bits per pixel:\t%d\n", hdr.BitsPerPixel)
+	fmt.Fprintf(w, "compression:\t%s\n", compressionName)
+	fmt.Fprintf(w, "orientation:\t%s\n", orientation)
+	fmt.Fprintf(w, "info header size:\t%d\n", le.Uint32(hdr.HeaderBytes[14:18]))
+	fmt.Fprintf(w, "image offset:\t%d\n", hdr.ImageOffset)
+	if hdr.BitsPerPixel >= 16 {
+		fmt.Fprintf(w, "masks:\t%#08x %#08x %#08x %#08x\n", hdr.RedMask, hdr.GreenMask, hdr.BlueMask, hdr.AlphaMask)
+	}
+	if p, ok := hdr.Config.ColorModel.(color.Palette); ok {
+		fmt.Fprintf(w, "palette size:\t%d\n", len(p))
+	}
+	fmt.Fprintf(w, "alpha:\t%v\n", hdr.AllowAlpha)
+	if hdr.ProfileSize > 0 {
+		fmt.Fprintf(w, "icc profile:\t%d bytes at offset %d\n", hdr.ProfileSize, hdr.ProfileOffset)
+	}
+}
@@ -1,41 +1,301 @@
+// Command imgcrop crops, inspects, tiles and converts very large images without
+// decoding them into memory.
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"image"
 	"io"
-	"log"
-	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 
-	"github.com/sebnyberg/imgcrop/bmpx"
-	"golang.org/x/image/bmp"
+	"github.com/sebnyberg/imgcrop/zstdx"
 )
 
+const usage = `usage: imgcrop <command> [flags] [args]
+
+Commands:
+  crop      crop a region of an image
+  info      print the header of an image
+  tile      split an image into a grid of tiles
+  convert   convert an image to another format
+
+Paths may be given as "-" to read from stdin or write to stdout. Inputs that
+are compressed with zstd are decompressed on the fly, and outputs with a .zst
+extension are compressed with zstd.
+
+Run "imgcrop <command> -h" for help on a command.
+`
+
+// Exit codes
+const (
+	exitOK    = 0 // success
+	exitError = 1 // the command failed
+	exitUsage = 2 // invalid command, flags or arguments
+)
+
+// usageError is returned by commands when they are given invalid arguments.
+type usageError struct {
+	error
+}
+
 func main() {
-	inflags := os.O_RDONLY
-	f, err := os.OpenFile("testdata/big.bmp", inflags, 0)
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command given by args and returns the exit code of the program.
+func run(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return exitUsage
+	}
+	cmds := map[string]func([]string) error{
+		"crop":    cropCmd,
+		"info":    infoCmd,
+		"tile":    tileCmd,
+		"convert": convertCmd,
+	}
+	cmd, ok := cmds[args[0]]
+	if !ok {
+		if args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+			fmt.Fprint(os.Stdout, usage)
+			return exitOK
+		}
+		fmt.Fprintf(os.Stderr, "imgcrop: unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
+	}
+
+	err := cmd(args[1:])
+	var uerr usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &uerr):
+		fmt.Fprintf(os.Stderr, "imgcrop %s: %v\n", args[0], err)
+		return exitUsage
+	default:
+		fmt.Fprintf(os.Stderr, "imgcrop %s: %v\n", args[0], err)
+		return exitError
+	}
+}
+
+// newFlagSet returns a flag set for a command which prints the provided usage
+// text followed by the defaults of its flags.
+func newFlagSet(name, text string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), text)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses args with fs. Errors other than a request for help are
+// returned as usage errors.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return usageError{err}
+}
+
+// parseRegion parses a region on the form x,y,w,h.
+func parseRegion(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, usageError{fmt.Errorf("invalid region %q, expected x,y,w,h", s)}
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return image.Rectangle{}, usageError{fmt.Errorf("invalid region %q, expected x,y,w,h", s)}
+		}
+		v[i] = n
+	}
+	if v[0] < 0 || v[1] < 0 || v[2] <= 0 || v[3] <= 0 {
+		return image.Rectangle{}, usageError{fmt.Errorf("invalid region %q, offsets must be non-negative and size positive", s)}
+	}
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// parseSize parses a size on the form WxH.
+func parseSize(s string) (image.Point, error) {
+	w, h, ok := strings.Cut(s, "x")
+	if ok {
+		x, errx := strconv.Atoi(w)
+		y, erry := strconv.Atoi(h)
+		if errx == nil && erry == nil && x > 0 && y > 0 {
+			return image.Pt(x, y), nil
+		}
+	}
+	return image.Point{}, usageError{fmt.Errorf("invalid size %q, expected WxH", s)}
+}
+
+// openInput opens the file at path for reading, or stdin if path is "-".
+//
+// Stdin is wrapped so that it does not implement io.Seeker, since it is
+// commonly a pipe that can not seek.
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(bufio.NewReader(os.Stdin)), nil
+	}
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("open file %q err, %w", path, err)
+	}
+	return f, nil
+}
+
+// output is a file or stdout that a command writes its result to.
+type output struct {
+	io.Writer
+	path string
+	f    *os.File
+	bw   *bufio.Writer
+	zw   io.WriteCloser // Compresses to f, if the path ends with .zst
+}
+
+// createOutput creates or truncates the file at path, or writes to stdout if
+// path is "-". Like stdin, stdout is not seekable.
+func createOutput(path string) (*output, error) {
+	if path == "-" {
+		bw := bufio.NewWriter(os.Stdout)
+		return &output{Writer: bw, path: path, bw: bw}, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("open file %q err, %w", path, err)
+	}
+	if strings.HasSuffix(path, ".zst") {
+		zw, err := zstdx.NewWriter(f, 0)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &output{Writer: zw, path: path, f: f, zw: zw}, nil
+	}
+	return &output{Writer: f, path: path, f: f}, nil
+}
+
+// close flushes and closes the output. If the command failed with err, an
+// output file is removed so that no partial result is left behind. The
+// returned error is err, or the error from closing the output.
+func (o *output) close(err error) error {
+	if o.bw != nil {
+		if err == nil {
+			err = o.bw.Flush()
+		}
+		return err
+	}
+	if o.zw != nil {
+		if cerr := o.zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := o.f.Close(); err == nil {
+		err = cerr
 	}
-	cfg, err := bmp.DecodeConfig(f)
 	if err != nil {
-		log.Fatalln(err)
-	}
-	width := cfg.Width
-	height := cfg.Height
-	dx := 16000
-	dy := 1000
-	for i := 0; ; i++ {
-		offx := rand.Intn(width - dx)
-		offy := rand.Intn(height - dy)
-		rect := image.Rect(offx, offy, offx+dx, offy+dy)
-		err = bmpx.Crop(f, io.Discard, rect)
+		os.Remove(o.path)
+	}
+	return err
+}
+
+// inputOutput returns the input and output paths from the positional arguments
+// of a command, which default to stdin and stdout.
+func inputOutput(args []string) (string, string, error) {
+	if len(args) > 2 {
+		return "", "", usageError{errors.New("too many arguments")}
+	}
+	paths := []string{"-", "-"}
+	copy(paths, args)
+	return paths[0], paths[1], nil
+}
+
+// randomAccess is implemented by files and by seekable zstd streams.
+type randomAccess interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// sniff returns the format of the image in r, "bmp", "tiff", "png" or "" if
+// unknown, and a reader of the whole image. Files are returned as-is so that
+// they can still seek, other readers are buffered.
+//
+// Images compressed with zstd are returned as a reader of the decompressed
+// image. Files in the zstd seekable format can still seek, other streams are
+// decompressed as they are read. The returned closer releases the decoders of
+// compressed images once the image has been read, it does not close r.
+func sniff(r io.Reader) (io.Reader, string, io.Closer, error) {
+	var magic []byte
+	if f, ok := r.(randomAccess); ok {
+		magic = make([]byte, 4)
+		n, err := f.ReadAt(magic, 0)
+		if err != nil && err != io.EOF {
+			return nil, "", nil, err
+		}
+		magic = magic[:n]
+	} else {
+		br := bufio.NewReader(r)
+		magic, _ = br.Peek(4)
+		r = br
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("BM")):
+		return r, "bmp", closers{}, nil
+	case bytes.Equal(magic, []byte("II\x2A\x00")), bytes.Equal(magic, []byte("MM\x00\x2A")),
+		bytes.Equal(magic, []byte("II\x2B\x00")), bytes.Equal(magic, []byte("MM\x00\x2B")): // BigTIFF
+		return r, "tiff", closers{}, nil
+	case bytes.Equal(magic, []byte("\x89PNG")):
+		return r, "png", closers{}, nil
+	case bytes.Equal(magic, []byte("\x28\xB5\x2F\xFD")): // zstd
+		if f, ok := r.(randomAccess); ok {
+			if sr, err := zstdx.NewSeekableReader(f); err == nil {
+				return sniffDecompressed(sr)
+			}
+			// Not seekable, rewind to decompress the stream from the start
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return nil, "", nil, err
+			}
+		}
+		zr, err := zstdx.NewReader(r)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, "", nil, err
 		}
-		if i%100 == 0 {
-			fmt.Println(i)
+		return sniffDecompressed(zr)
+	}
+	return r, "", closers{}, nil
+}
+
+// sniffDecompressed sniffs the image decompressed by dec, and adds dec to the
+// returned closer.
+func sniffDecompressed(dec io.ReadCloser) (io.Reader, string, io.Closer, error) {
+	r, format, c, err := sniff(dec)
+	if err != nil {
+		dec.Close()
+		return nil, "", nil, err
+	}
+	return r, format, closers{c, dec}, nil
+}
+
+// closers closes each of its closers in order, and returns the first error.
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if cerr := c.Close(); err == nil {
+			err = cerr
 		}
 	}
+	return err
 }
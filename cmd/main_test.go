@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/sebnyberg/imgcrop/zstdx"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestParseRegion(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want image.Rectangle
+		ok   bool
+	}{
+		{"0,0,1,1", image.Rect(0, 0, 1, 1), true},
+		{"10, 20, 30, 40", image.Rect(10, 20, 40, 60), true},
+		{"1,2,3", image.Rectangle{}, false},
+		{"1,2,3,4,5", image.Rectangle{}, false},
+		{"a,2,3,4", image.Rectangle{}, false},
+		{"-1,2,3,4", image.Rectangle{}, false},
+		{"1,2,0,4", image.Rectangle{}, false},
+	} {
+		got, err := parseRegion(tc.in)
+		if !tc.ok {
+			var uerr usageError
+			require.True(t, errors.As(err, &uerr), tc.in)
+			continue
+		}
+		require.NoError(t, err, tc.in)
+		require.Equal(t, tc.want, got, tc.in)
+	}
+}
+
+func TestRunExitCodes(t *testing.T) {
+	require.Equal(t, exitUsage, run(nil))
+	require.Equal(t, exitUsage, run([]string{"unknown"}))
+	require.Equal(t, exitUsage, run([]string{"crop", "1,2,3"}))
+	require.Equal(t, exitUsage, run([]string{"convert", "-format", "webp", "src.png"}))
+	require.Equal(t, exitError, run([]string{"info", "testdata/does-not-exist.bmp"}))
+}
+
+func TestSniffZSTD(t *testing.T) {
+	src := append([]byte("BM"), make([]byte, 100)...)
+	var compressed bytes.Buffer
+	zw, err := zstdx.NewWriter(&compressed, 0)
+	require.NoError(t, err)
+	_, err = zw.Write(src)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for _, r := range []io.Reader{
+		bytes.NewReader(compressed.Bytes()),
+		io.MultiReader(bytes.NewReader(compressed.Bytes())), // Not seekable
+	} {
+		got, format, dec, err := sniff(r)
+		require.NoError(t, err)
+		require.Equal(t, "bmp", format)
+		b, err := io.ReadAll(got)
+		require.NoError(t, err)
+		require.Equal(t, src, b)
+		// The decoder is released by the returned closer
+		require.Len(t, dec, 2)
+		require.NoError(t, dec.Close())
+	}
+}
+
+func TestCropRLE(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bmp")
+	require.NoError(t, os.WriteFile(src, rle8BMP(), 0600))
+
+	dst := filepath.Join(dir, "dst.bmp")
+	require.Equal(t, exitOK, run([]string{"crop", "-rle", "1,0,2,2", src, dst}))
+	f, err := os.Open(dst)
+	require.NoError(t, err)
+	defer f.Close()
+	hdr, err := bmpx.DecodeHeader(f)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), binary.LittleEndian.Uint32(hdr.HeaderBytes[30:34]), "rle8")
+
+	// Crop the whole image to uncompressed BMP to check the pixels
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	var b bytes.Buffer
+	require.NoError(t, bmpx.Crop(f, &b, image.Rect(0, 0, 2, 2)))
+	img, err := bmp.Decode(&b)
+	require.NoError(t, err)
+	black, red := color.RGBA{0, 0, 0, 0xff}, color.RGBA{0x10, 0x20, 0x30, 0xff}
+	require.Equal(t, black, color.RGBAModel.Convert(img.At(0, 0)))
+	require.Equal(t, red, color.RGBAModel.Convert(img.At(1, 0)))
+	require.Equal(t, red, color.RGBAModel.Convert(img.At(0, 1)))
+	require.Equal(t, red, color.RGBAModel.Convert(img.At(1, 1)))
+
+	// RLE output must be a file that can seek
+	require.Equal(t, exitUsage, run([]string{"crop", "-rle", "0,0,2,2", src, "-"}))
+	require.Equal(t, exitUsage, run([]string{"crop", "-rle", "0,0,2,2", src, dst + ".zst"}))
+}
+
+// rle8BMP returns a bottom-up RLE8 compressed BMP of 4x2 pixels, with the top
+// row 0, 0, 1, 1 and the bottom row 1, 1, 1, 1 in a palette of black and red.
+func rle8BMP() []byte {
+	data := []byte{
+		4, 1, 0, 0, // Bottom row, end of line
+		2, 0, 2, 1, 0, 1, // Top row, end of bitmap
+	}
+	palette := []byte{0, 0, 0, 0, 0x30, 0x20, 0x10, 0}
+	offset := 14 + 40 + len(palette)
+
+	b := make([]byte, offset, offset+len(data))
+	le := binary.LittleEndian
+	copy(b, "BM")
+	le.PutUint32(b[2:], uint32(offset+len(data)))
+	le.PutUint32(b[10:], uint32(offset))
+	le.PutUint32(b[14:], 40)
+	le.PutUint32(b[18:], 4) // Width
+	le.PutUint32(b[22:], 2) // Height
+	le.PutUint16(b[26:], 1) // Planes
+	le.PutUint16(b[28:], 8) // Bits per pixel
+	le.PutUint32(b[30:], 1) // RLE8
+	le.PutUint32(b[34:], uint32(len(data)))
+	le.PutUint32(b[46:], 2) // Colors used
+	copy(b[54:], palette)
+	return append(b, data...)
+}
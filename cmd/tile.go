@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/sebnyberg/imgcrop/bmpx"
+)
+
+const tileUsage = `usage: imgcrop tile [flags] <src.bmp> <dstdir>
+
+Splits a BMP into a grid of tiles that are written to dstdir. src may be "-" to
+read from stdin.
+
+The name of each tile is given by a Go template, where .X and .Y are the column
+and row index of the tile, and .Region is its region of the source image.
+
+The source is read once, and the file of each tile is open from its first row
+to its last. With -overlap, tiles in up to ceil(height / (height - overlap))
+rows of the grid are open at once, so a large overlap relative to the tile
+height may need many open files. For example, 512x512 tiles with an overlap of
+500 keep 43 rows of tiles open.
+
+Flags:
+`
+
+// tileData is passed to the filename template of each tile.
+type tileData struct {
+	X, Y   int
+	Region image.Rectangle
+}
+
+func tileCmd(args []string) error {
+	fs := newFlagSet("tile", tileUsage)
+	width := fs.Int("width", 512, "tile width in pixels")
+	height := fs.Int("height", 512, "tile height in pixels")
+	overlap := fs.Int("overlap", 0, "overlap between adjacent tiles in pixels")
+	name := fs.String("name", "tile_{{.X}}_{{.Y}}.bmp", "filename template")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return usageError{errors.New("expected source and destination paths")}
+	}
+	if *width <= 0 || *height <= 0 || *overlap < 0 || *overlap >= *width || *overlap >= *height {
+		return usageError{errors.New("tile size must be positive, and overlap non-negative and less than the tile size")}
+	}
+	srcPath, dstDir := fs.Arg(0), fs.Arg(1)
+	tmpl, err := template.New("name").Parse(*name)
+	if err != nil {
+		return usageError{fmt.Errorf("parse filename template err, %w", err)}
+	}
+
+	src, err := openInput(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	r, _, dec, err := sniff(src)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	if err := os.MkdirAll(dstDir, 0750); err != nil {
+		return err
+	}
+	size := image.Pt(*width, *height)
+	return bmpx.Tile(r, size, *overlap, func(x, y int, region image.Rectangle) (io.WriteCloser, error) {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, tileData{X: x, Y: y, Region: region}); err != nil {
+			return nil, err
+		}
+		path := filepath.Join(dstDir, b.String())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("open file %q err, %w", path, err)
+		}
+		return f, nil
+	})
+}
@@ -0,0 +1,482 @@
+package tiffx
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// layout describes how the image of an IFD is stored in a baseline TIFF, and
+// converts its rows to 8-bit RGBA.
+//
+// Bilevel, grayscale, paletted and RGB images are supported, with 1, 2, 4, 8
+// or 16 bits per sample and an optional alpha sample. Samples must be stored
+// chunky, in strips or tiles that are uncompressed or compressed with PackBits,
+// LZW or Deflate. Compressed images with 8 or 16 bits per sample may use the
+// horizontal predictor.
+type layout struct {
+	bo            binary.ByteOrder
+	width, height int
+	photometric   uint32
+	compression   uint32
+	predictor     uint32
+	bitsPerSample int
+	samples       int // Samples per pixel
+	alpha         int // Index of the alpha sample, or -1 if there is none
+
+	// premultiplied is set when the color samples are premultiplied by alpha
+	premultiplied bool
+
+	// palette holds the RGB colors of paletted images
+	palette [][3]byte
+
+	// rowsPerStrip is set for images stored in strips, and tileWidth and
+	// tileLength for images stored in tiles. The offsets and byte counts are
+	// those of the strips or tiles.
+	rowsPerStrip          int
+	tileWidth, tileLength int
+	offsets               []uint64
+	counts                []uint64
+}
+
+// readLayout reads the first IFD of the TIFF in r and returns its layout.
+func readLayout(r io.ReaderAt) (*layout, error) {
+	dirs, _, err := readPages(r, 1)
+	if err != nil {
+		return nil, err
+	}
+	return newLayout(dirs[0])
+}
+
+// newLayout validates the fields of d and returns the layout of its image.
+func newLayout(d ifd) (*layout, error) {
+	l := &layout{bo: d.bo, alpha: -1}
+	width, err := d.uint(tagImageWidth, 0)
+	if err != nil {
+		return nil, err
+	}
+	height, err := d.uint(tagImageLength, 0)
+	if err != nil {
+		return nil, err
+	}
+	if width == 0 || height == 0 || width > 1<<30 || height > 1<<30 {
+		return nil, errors.New("unsupported image dimensions")
+	}
+	l.width, l.height = int(width), int(height)
+
+	if l.compression, err = d.uint(tagCompression, compressionNone); err != nil {
+		return nil, err
+	}
+	switch l.compression {
+	case compressionNone, compressionPackBits, compressionLZW, compressionDeflate, compressionDeflateOld:
+	default:
+		return nil, errors.New("unsupported compression")
+	}
+	if l.predictor, err = d.uint(tagPredictor, predictorNone); err != nil {
+		return nil, err
+	}
+	planar, err := d.uint(tagPlanarConfiguration, planarChunky)
+	if err != nil {
+		return nil, err
+	}
+	if planar != planarChunky {
+		return nil, errors.New("unsupported planar configuration")
+	}
+
+	// Samples must have the same size
+	samples, err := d.uint(tagSamplesPerPixel, 1)
+	if err != nil {
+		return nil, err
+	}
+	bits, err := d.uints(tagBitsPerSample)
+	if err != nil {
+		return nil, err
+	}
+	if len(bits) == 0 {
+		bits = []uint32{1}
+	}
+	if samples == 0 || samples > 16 || (len(bits) != 1 && len(bits) != int(samples)) {
+		return nil, errors.New("unsupported samples per pixel")
+	}
+	for _, n := range bits {
+		if n != bits[0] {
+			return nil, errors.New("unsupported bits per sample")
+		}
+	}
+	l.samples, l.bitsPerSample = int(samples), int(bits[0])
+	switch {
+	case l.predictor == predictorNone:
+	case l.predictor == predictorHorizontal && l.compression != compressionNone &&
+		(l.bitsPerSample == 8 || l.bitsPerSample == 16):
+	default:
+		return nil, errors.New("unsupported predictor")
+	}
+
+	// Color samples followed by extra samples, of which the first may be alpha
+	if l.photometric, err = d.uint(tagPhotometricInterpretation, 0); err != nil {
+		return nil, err
+	}
+	var colors int
+	switch l.photometric {
+	case photometricWhiteIsZero, photometricBlackIsZero:
+		colors = 1
+		switch l.bitsPerSample {
+		case 1, 2, 4, 8, 16:
+		default:
+			return nil, errors.New("unsupported bits per sample")
+		}
+	case photometricPaletted:
+		colors = 1
+		switch l.bitsPerSample {
+		case 1, 2, 4, 8:
+		default:
+			return nil, errors.New("unsupported bits per sample")
+		}
+		cmap, err := d.uints(tagColorMap)
+		if err != nil {
+			return nil, err
+		}
+		n := 1 << l.bitsPerSample
+		if len(cmap) != 3*n {
+			return nil, errors.New("invalid color map")
+		}
+		l.palette = make([][3]byte, n)
+		for i := range l.palette {
+			l.palette[i] = [3]byte{byte(cmap[i] >> 8), byte(cmap[n+i] >> 8), byte(cmap[2*n+i] >> 8)}
+		}
+	case photometricRGB:
+		colors = 3
+		if l.bitsPerSample != 8 && l.bitsPerSample != 16 {
+			return nil, errors.New("unsupported bits per sample")
+		}
+	default:
+		return nil, errors.New("unsupported photometric interpretation")
+	}
+	if l.samples < colors {
+		return nil, errors.New("unsupported samples per pixel")
+	}
+	extra, err := d.uints(tagExtraSamples)
+	if err != nil {
+		return nil, err
+	}
+	if l.samples > colors && len(extra) > 0 {
+		switch extra[0] {
+		case extraSamplesAssociated:
+			l.alpha, l.premultiplied = colors, true
+		case extraSamplesUnassociated:
+			l.alpha = colors
+		}
+	}
+
+	// Strips or tiles
+	if _, tiled := d.field(tagTileWidth); tiled {
+		err = l.readTiles(d)
+	} else {
+		err = l.readStrips(d)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// readStrips reads the rows per strip, strip offsets and strip byte counts of
+// d.
+func (l *layout) readStrips(d ifd) error {
+	rowsPerStrip, err := d.uint(tagRowsPerStrip, uint32(l.height))
+	if err != nil {
+		return err
+	}
+	if rowsPerStrip == 0 {
+		return errors.New("invalid rows per strip")
+	}
+	if int64(rowsPerStrip) > int64(l.height) {
+		rowsPerStrip = uint32(l.height)
+	}
+	l.rowsPerStrip = int(rowsPerStrip)
+	if l.offsets, err = d.uint64s(tagStripOffsets); err != nil {
+		return err
+	}
+	if l.counts, err = d.uint64s(tagStripByteCounts); err != nil {
+		return err
+	}
+	strips := (l.height + l.rowsPerStrip - 1) / l.rowsPerStrip
+	if len(l.counts) == 0 && l.compression == compressionNone {
+		// Uncompressed strips may omit their sizes
+		l.counts = make([]uint64, strips)
+		for i := range l.counts {
+			from, to := l.stripRows(i)
+			l.counts[i] = uint64(to-from) * uint64(l.rowBytes())
+		}
+	}
+	if len(l.offsets) != strips || len(l.counts) != strips {
+		return errors.New("invalid strip offsets")
+	}
+	if l.compression == compressionNone {
+		// Rows of uncompressed strips are read at their offsets
+		for i, n := range l.counts {
+			from, to := l.stripRows(i)
+			if n < uint64(to-from)*uint64(l.rowBytes()) {
+				return errors.New("invalid strip byte counts")
+			}
+		}
+	}
+	return nil
+}
+
+// readTiles reads the tile dimensions, tile offsets and tile byte counts of d.
+// Tiles are stored left to right, top to bottom, and tiles on the right and
+// bottom edges are padded to the full tile size.
+func (l *layout) readTiles(d ifd) error {
+	tileWidth, err := d.uint(tagTileWidth, 0)
+	if err != nil {
+		return err
+	}
+	tileLength, err := d.uint(tagTileLength, 0)
+	if err != nil {
+		return err
+	}
+	if tileWidth == 0 || tileLength == 0 || tileWidth > 1<<16 || tileLength > 1<<16 {
+		return errors.New("unsupported tile dimensions")
+	}
+	l.tileWidth, l.tileLength = int(tileWidth), int(tileLength)
+	if l.tileWidth*l.samples*l.bitsPerSample%8 != 0 {
+		// Rows of tiles are stitched together a byte at a time
+		return errors.New("unsupported tile width")
+	}
+	if l.offsets, err = d.uint64s(tagTileOffsets); err != nil {
+		return err
+	}
+	if l.counts, err = d.uint64s(tagTileByteCounts); err != nil {
+		return err
+	}
+	across := (l.width + l.tileWidth - 1) / l.tileWidth
+	down := (l.height + l.tileLength - 1) / l.tileLength
+	tileBytes := l.tileLength * l.tileRowBytes()
+	if len(l.counts) == 0 && l.compression == compressionNone {
+		l.counts = make([]uint64, across*down)
+		for i := range l.counts {
+			l.counts[i] = uint64(tileBytes)
+		}
+	}
+	if int64(len(l.offsets)) != int64(across)*int64(down) || len(l.counts) != len(l.offsets) {
+		return errors.New("invalid tile offsets")
+	}
+	if l.compression == compressionNone {
+		for _, n := range l.counts {
+			if n < uint64(tileBytes) {
+				return errors.New("invalid tile byte counts")
+			}
+		}
+	}
+	return nil
+}
+
+// rowBytes returns the number of bytes in a row of the image. Rows with less
+// than 8 bits per pixel are padded to a byte boundary.
+func (l *layout) rowBytes() int {
+	return (l.width*l.samples*l.bitsPerSample + 7) / 8
+}
+
+// tileRowBytes returns the number of bytes in a row of a tile.
+func (l *layout) tileRowBytes() int {
+	return l.tileWidth * l.samples * l.bitsPerSample / 8
+}
+
+// stripRows returns the rows [from, to) of the image that are stored in the
+// i'th strip.
+func (l *layout) stripRows(i int) (from, to int) {
+	from = i * l.rowsPerStrip
+	to = from + l.rowsPerStrip
+	if to > l.height {
+		to = l.height
+	}
+	return from, to
+}
+
+// openBlock returns a reader of the decompressed rows of the i'th strip or
+// tile.
+func (l *layout) openBlock(r io.ReaderAt, i int) (io.Reader, error) {
+	sr := io.NewSectionReader(r, int64(l.offsets[i]), int64(l.counts[i]))
+	return decompress(sr, l.compression)
+}
+
+// sample returns the value of sample s of the pixel at x in row, without
+// scaling.
+func (l *layout) sample(row []byte, x, s int) uint32 {
+	i := x*l.samples + s
+	switch l.bitsPerSample {
+	case 8:
+		return uint32(row[i])
+	case 16:
+		return uint32(l.bo.Uint16(row[2*i:]))
+	}
+	bit := i * l.bitsPerSample
+	shift := 8 - l.bitsPerSample - bit%8
+	return uint32(row[bit/8]>>shift) & (1<<l.bitsPerSample - 1)
+}
+
+// sample8 returns the value of sample s of the pixel at x in row, scaled to 8
+// bits.
+func (l *layout) sample8(row []byte, x, s int) byte {
+	v := l.sample(row, x, s)
+	switch l.bitsPerSample {
+	case 8:
+		return byte(v)
+	case 16:
+		return byte(v >> 8)
+	}
+	return byte(v * 255 / (1<<l.bitsPerSample - 1))
+}
+
+// cropRows reads the rows of the region from the strips that intersect it, and
+// calls write with each row converted to 8-bit RGBA, top to bottom.
+//
+// Rows of uncompressed strips are read at their offsets, and only the bytes
+// that hold the columns of the region are read. Compressed strips are
+// decompressed from the start of the strip until the last row of the region.
+// Strips above and below the region are never read.
+//
+// Tiled images are read by cropTiles.
+func (l *layout) cropRows(src io.ReaderAt, region image.Rectangle, write func(row []byte) error) error {
+	if l.tileWidth > 0 {
+		return l.cropTiles(src, region, write)
+	}
+	rowBytes := l.rowBytes()
+	pixelBits := l.samples * l.bitsPerSample
+	left := region.Min.X * pixelBits / 8
+	right := (region.Max.X*pixelBits + 7) / 8
+	row := make([]byte, rowBytes)
+	out := make([]byte, 4*region.Dx())
+	for i := region.Min.Y / l.rowsPerStrip; i*l.rowsPerStrip < region.Max.Y; i++ {
+		from, to := l.stripRows(i)
+		if to > region.Max.Y {
+			to = region.Max.Y
+		}
+		var r io.Reader
+		if l.compression != compressionNone {
+			var err error
+			if r, err = l.openBlock(src, i); err != nil {
+				return err
+			}
+		}
+		for y := from; y < to; y++ {
+			if r == nil {
+				if y < region.Min.Y {
+					continue
+				}
+				off := int64(l.offsets[i]) + int64(y-from)*int64(rowBytes)
+				if err := ioutilx.ReadFullAt(src, row[left:right], off+int64(left)); err != nil {
+					return err
+				}
+			} else if _, err := io.ReadFull(r, row); err != nil {
+				return ioutilx.NoEOF(err)
+			}
+			if y < region.Min.Y {
+				continue
+			}
+			if l.predictor == predictorHorizontal {
+				unpredict(row, l.samples, l.bitsPerSample, l.bo)
+			}
+			l.toRGBA(out, row, region.Min.X, region.Max.X)
+			if err := write(out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cropTiles is cropRows for tiled images. Only the tiles that intersect the
+// region are read, one row of tiles at a time. The rows of the region that are
+// stored in a row of tiles are stitched together in a buffer, from which they
+// are converted and written before the next row of tiles is read.
+//
+// Rows of uncompressed tiles are read at their offsets, and compressed tiles
+// are decompressed until the last row of the region.
+func (l *layout) cropTiles(src io.ReaderAt, region image.Rectangle, write func(row []byte) error) error {
+	tw, th := l.tileWidth, l.tileLength
+	tileRowBytes := l.tileRowBytes()
+	across := (l.width + tw - 1) / tw
+
+	// Columns of tiles [tx0, tx1) intersect the region
+	tx0, tx1 := region.Min.X/tw, (region.Max.X+tw-1)/tw
+	bandRowBytes := (tx1 - tx0) * tileRowBytes
+	band := make([]byte, th*bandRowBytes)
+	row := make([]byte, tileRowBytes)
+	out := make([]byte, 4*region.Dx())
+	for ty := region.Min.Y / th; ty*th < region.Max.Y; ty++ {
+		// Rows [from, to) of the tiles are in the region
+		from, to := 0, th
+		if region.Min.Y > ty*th {
+			from = region.Min.Y - ty*th
+		}
+		if region.Max.Y < (ty+1)*th {
+			to = region.Max.Y - ty*th
+		}
+		for tx := tx0; tx < tx1; tx++ {
+			i := ty*across + tx
+			col := (tx - tx0) * tileRowBytes
+			if l.compression == compressionNone {
+				for y := from; y < to; y++ {
+					off := int64(l.offsets[i]) + int64(y)*int64(tileRowBytes)
+					if err := ioutilx.ReadFullAt(src, band[y*bandRowBytes+col:][:tileRowBytes], off); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			r, err := l.openBlock(src, i)
+			if err != nil {
+				return err
+			}
+			for y := 0; y < to; y++ {
+				if _, err := io.ReadFull(r, row); err != nil {
+					return ioutilx.NoEOF(err)
+				}
+				if y < from {
+					continue
+				}
+				if l.predictor == predictorHorizontal {
+					unpredict(row, l.samples, l.bitsPerSample, l.bo)
+				}
+				copy(band[y*bandRowBytes+col:], row)
+			}
+		}
+		for y := from; y < to; y++ {
+			l.toRGBA(out, band[y*bandRowBytes:(y+1)*bandRowBytes], region.Min.X-tx0*tw, region.Max.X-tx0*tw)
+			if err := write(out); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toRGBA converts the pixels in columns [x0, x1) of a row of the image to
+// 8-bit RGBA pixels in dst.
+func (l *layout) toRGBA(dst, row []byte, x0, x1 int) {
+	for x := x0; x < x1; x++ {
+		p := dst[4*(x-x0) : 4*(x-x0)+4]
+		switch l.photometric {
+		case photometricWhiteIsZero, photometricBlackIsZero:
+			v := l.sample8(row, x, 0)
+			if l.photometric == photometricWhiteIsZero {
+				v = 0xff - v
+			}
+			p[0], p[1], p[2] = v, v, v
+		case photometricPaletted:
+			c := l.palette[l.sample(row, x, 0)]
+			p[0], p[1], p[2] = c[0], c[1], c[2]
+		case photometricRGB:
+			p[0], p[1], p[2] = l.sample8(row, x, 0), l.sample8(row, x, 1), l.sample8(row, x, 2)
+		}
+		p[3] = 0xff
+		if l.alpha >= 0 {
+			p[3] = l.sample8(row, x, l.alpha)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package tiffx
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+	"golang.org/x/image/tiff/lzw"
+)
+
+// decompress returns a reader of the decompressed contents of a strip that is
+// compressed with the provided compression.
+func decompress(r io.Reader, compression uint32) (io.Reader, error) {
+	switch compression {
+	case compressionNone:
+		return r, nil
+	case compressionPackBits:
+		return &packBitsReader{r: bufio.NewReader(r)}, nil
+	case compressionLZW:
+		return lzw.NewReader(bufio.NewReader(r), lzw.MSB, 8), nil
+	case compressionDeflate, compressionDeflateOld:
+		return zlib.NewReader(bufio.NewReader(r))
+	}
+	return nil, errors.New("unsupported compression")
+}
+
+// unpredict reverses horizontal differencing of a row with the provided
+// number of samples per pixel and 8 or 16 bits per sample, where each sample
+// has been stored as the difference to the same sample of the previous pixel.
+func unpredict(row []byte, samples, bitsPerSample int, bo binary.ByteOrder) {
+	switch bitsPerSample {
+	case 8:
+		for i := samples; i < len(row); i++ {
+			row[i] += row[i-samples]
+		}
+	case 16:
+		for i := 2 * samples; i+1 < len(row); i += 2 {
+			bo.PutUint16(row[i:], bo.Uint16(row[i:])+bo.Uint16(row[i-2*samples:]))
+		}
+	}
+}
+
+// packBitsReader decodes PackBits compressed data, which is a sequence of
+// runs of a repeated byte and literal bytes.
+type packBitsReader struct {
+	r   io.ByteReader
+	run int  // Number of times to repeat b
+	lit int  // Number of literal bytes left to read
+	b   byte // Repeated byte
+}
+
+func (r *packBitsReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		switch {
+		case r.lit > 0:
+			b, err := r.r.ReadByte()
+			if err != nil {
+				return n, ioutilx.NoEOF(err)
+			}
+			p[n] = b
+			n++
+			r.lit--
+		case r.run > 0:
+			for ; n < len(p) && r.run > 0; n++ {
+				p[n] = r.b
+				r.run--
+			}
+		default:
+			// Read the header of the next run
+			h, err := r.r.ReadByte()
+			if err != nil {
+				if n > 0 && err == io.EOF {
+					err = nil
+				}
+				return n, err
+			}
+			switch c := int8(h); {
+			case c >= 0:
+				r.lit = int(c) + 1
+			case c != -128:
+				if r.b, err = r.r.ReadByte(); err != nil {
+					return n, ioutilx.NoEOF(err)
+				}
+				r.run = 1 - int(c)
+			}
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,20 @@
+package tiffx
+
+import (
+	"image"
+	"io"
+)
+
+// Convert converts the first image of the baseline TIFF in src to a TIFF in
+// the strict profile, see DecodeHeader.
+//
+// Unlike the strict profile, the input may be stored in any number of strips,
+// in any order, with IFDs anywhere in the file and in either byte order. The IFD
+// is read first, after which strips are read at their offsets in row order and
+// converted to RGBA one row at a time. Memory use is therefore bounded by the
+// size of the IFD and a couple of rows, rather than the size of the image.
+//
+// See layout for the supported pixel formats and compressions.
+func Convert(src io.ReaderAt, dst io.Writer) error {
+	return CropAt(src, dst, image.Rect(0, 0, 1<<30, 1<<30))
+}
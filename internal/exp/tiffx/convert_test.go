@@ -0,0 +1,403 @@
+package tiffx
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvert(t *testing.T) {
+	for _, tc := range []baselineImage{
+		{photometric: photometricBlackIsZero, bits: 1, samples: 1},
+		{photometric: photometricWhiteIsZero, bits: 4, samples: 1},
+		{photometric: photometricBlackIsZero, bits: 8, samples: 1},
+		{photometric: photometricBlackIsZero, bits: 16, samples: 1},
+		{photometric: photometricBlackIsZero, bits: 8, samples: 2, extra: []uint32{extraSamplesUnassociated}},
+		{photometric: photometricPaletted, bits: 2, samples: 1},
+		{photometric: photometricPaletted, bits: 8, samples: 1},
+		{photometric: photometricRGB, bits: 8, samples: 3},
+		{photometric: photometricRGB, bits: 8, samples: 4, extra: []uint32{extraSamplesAssociated}},
+		{photometric: photometricRGB, bits: 8, samples: 4, extra: []uint32{extraSamplesUnassociated}},
+		{photometric: photometricRGB, bits: 8, samples: 4, extra: []uint32{extraSamplesUnspecified}},
+		{photometric: photometricRGB, bits: 16, samples: 4, extra: []uint32{extraSamplesUnassociated}},
+	} {
+		for _, compression := range []uint32{compressionNone, compressionPackBits, compressionLZW, compressionDeflate} {
+			for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+				m := tc
+				m.width = 1 + rand.Intn(50)
+				m.height = 1 + rand.Intn(50)
+				m.rowsPerStrip = 1 + rand.Intn(m.height)
+				if rand.Intn(2) == 0 {
+					m.tileWidth, m.tileLength = 16*(1+rand.Intn(2)), 1+rand.Intn(20)
+				}
+				m.bigTIFF = rand.Intn(3) == 0
+				m.compression = compression
+				if compression != compressionNone && (m.bits == 8 || m.bits == 16) && rand.Intn(2) == 0 {
+					m.predictor = predictorHorizontal
+				}
+				m.randPix()
+				name := fmt.Sprintf("photometric %v, %vx%v bits, compression %v, predictor %v, tiles %vx%v, bigtiff %v, %v", m.photometric, m.samples, m.bits, m.compression, m.predictor, m.tileWidth, m.tileLength, m.bigTIFF, bo)
+				src := encodeBaseline(bo, m)
+
+				var dst bytes.Buffer
+				err := Convert(bytes.NewReader(src), &dst)
+				require.NoError(t, err, name)
+				r := bytes.NewReader(dst.Bytes())
+				hdr, err := DecodeHeader(r)
+				require.NoError(t, err, name)
+				require.Equal(t, m.extra != nil && m.extra[0] == extraSamplesAssociated, hdr.Premultiplied, name)
+				got, err := io.ReadAll(r)
+				require.NoError(t, err, name)
+				require.Equal(t, m.rgba(bo), got, name)
+			}
+		}
+	}
+}
+
+func TestConvertUnsupported(t *testing.T) {
+	for _, m := range []baselineImage{
+		{photometric: 5, bits: 8, samples: 4}, // CMYK
+		{photometric: photometricRGB, bits: 4, samples: 3},
+		{photometric: photometricRGB, bits: 8, samples: 3, compression: 7}, // JPEG
+		{photometric: photometricRGB, bits: 8, samples: 3, predictor: predictorHorizontal},
+		{photometric: photometricBlackIsZero, bits: 4, samples: 1, compression: compressionLZW, predictor: predictorHorizontal},
+		{photometric: photometricBlackIsZero, bits: 4, samples: 1, tileWidth: 3, tileLength: 4}, // Tiles not byte aligned
+	} {
+		m.width, m.height, m.rowsPerStrip = 4, 4, 4
+		if m.compression == 0 {
+			m.compression = compressionNone
+		}
+		m.randPix()
+		err := Convert(bytes.NewReader(encodeBaseline(binary.LittleEndian, m)), &bytes.Buffer{})
+		require.Error(t, err, "%+v", m)
+	}
+}
+
+// baselineImage is an image that is encoded by encodeBaseline.
+type baselineImage struct {
+	width, height int
+	photometric   uint32
+	bits          int
+	samples       int
+	extra         []uint32
+	rowsPerStrip  int
+	tileWidth     int // Tiled if set, with tileLength rows per tile
+	tileLength    int
+	bigTIFF       bool
+	compression   uint32
+	predictor     uint32
+	colorMap      []uint32
+	pix           []byte
+}
+
+// rowBytes returns the number of bytes in a row of the image.
+func (m *baselineImage) rowBytes() int {
+	return (m.width*m.samples*m.bits + 7) / 8
+}
+
+// randPix fills the image with random pixels and palette, with runs of equal
+// bytes that are compressed by PackBits.
+func (m *baselineImage) randPix() {
+	m.pix = make([]byte, m.rowBytes()*m.height)
+	for i := 0; i < len(m.pix); {
+		n := 1 + rand.Intn(10)
+		v := byte(rand.Intn(256))
+		for j := 0; j < n && i < len(m.pix); j++ {
+			m.pix[i] = v
+			i++
+		}
+	}
+	if m.photometric == photometricPaletted {
+		m.colorMap = make([]uint32, 3<<m.bits)
+		for i := range m.colorMap {
+			m.colorMap[i] = uint32(rand.Intn(1 << 16))
+		}
+	}
+}
+
+// rgba returns the pixels of the image as 8-bit RGBA. Samples are read one bit
+// at a time, most significant bit first.
+func (m *baselineImage) rgba(bo binary.ByteOrder) []byte {
+	res := make([]byte, 0, 4*m.width*m.height)
+	for y := 0; y < m.height; y++ {
+		row := m.pix[y*m.rowBytes():]
+		var bit int
+		next := func() uint32 {
+			var v uint32
+			for i := 0; i < m.bits; i++ {
+				v = v<<1 | uint32(row[bit/8]>>(7-bit%8))&1
+				bit++
+			}
+			if m.bits == 16 && bo == binary.LittleEndian {
+				v = v>>8 | (v&0xff)<<8
+			}
+			return v
+		}
+		scale := func(v uint32) byte {
+			if m.bits == 16 {
+				return byte(v >> 8)
+			}
+			return byte(v * 255 / (1<<m.bits - 1))
+		}
+		for x := 0; x < m.width; x++ {
+			samples := make([]uint32, m.samples)
+			for i := range samples {
+				samples[i] = next()
+			}
+			var p [4]byte
+			switch m.photometric {
+			case photometricWhiteIsZero:
+				v := 255 - scale(samples[0])
+				p = [4]byte{v, v, v, 0xff}
+			case photometricBlackIsZero:
+				v := scale(samples[0])
+				p = [4]byte{v, v, v, 0xff}
+			case photometricPaletted:
+				n := 1 << m.bits
+				i := samples[0]
+				p = [4]byte{byte(m.colorMap[i] >> 8), byte(m.colorMap[n+int(i)] >> 8), byte(m.colorMap[2*n+int(i)] >> 8), 0xff}
+			case photometricRGB:
+				p = [4]byte{scale(samples[0]), scale(samples[1]), scale(samples[2]), 0xff}
+			}
+			if m.extra != nil && m.extra[0] != extraSamplesUnspecified {
+				p[3] = scale(samples[len(samples)-len(m.extra)])
+			}
+			res = append(res, p[:]...)
+		}
+	}
+	return res
+}
+
+// encodeBaseline encodes a TIFF with the image stored in strips or tiles that
+// are written in reverse order, followed by the IFD at the end of the file.
+func encodeBaseline(bo binary.ByteOrder, m baselineImage) []byte {
+	b := make([]byte, headerLen)
+	if m.bigTIFF {
+		b = make([]byte, bigHeaderLen)
+	}
+	b, off := appendBaseline(b, bo, m)
+	putTestHeader(b, bo, m.bigTIFF, off)
+	return b
+}
+
+// appendBaseline appends the strips or tiles of m in reverse order to b,
+// followed by the IFD of m with any extra fields. It returns the extended b and
+// the offset of the IFD.
+func appendBaseline(b []byte, bo binary.ByteOrder, m baselineImage, extra ...testField) ([]byte, int) {
+	offsetType := uint16(typeLong)
+	if m.bigTIFF {
+		offsetType = typeLong8
+	}
+	blocks, blockRowBytes := m.blocks()
+	offsets := make([]uint32, len(blocks))
+	counts := make([]uint32, len(blocks))
+	for i := len(blocks) - 1; i >= 0; i-- {
+		data := blocks[i]
+		if m.predictor == predictorHorizontal {
+			for i := 0; i < len(data); i += blockRowBytes {
+				predict(data[i:i+blockRowBytes], m.samples, m.bits, bo)
+			}
+		}
+		data = compressStrip(data, blockRowBytes, m.compression)
+		offsets[i] = uint32(len(b))
+		counts[i] = uint32(len(data))
+		b = append(b, data...)
+	}
+
+	bits := make([]uint32, m.samples)
+	for i := range bits {
+		bits[i] = uint32(m.bits)
+	}
+	fields := map[uint16]testField{}
+	for _, f := range []testField{
+		{tagImageWidth, typeShort, []uint32{uint32(m.width)}},
+		{tagImageLength, typeLong, []uint32{uint32(m.height)}},
+		{tagBitsPerSample, typeShort, bits},
+		{tagCompression, typeShort, []uint32{m.compression}},
+		{tagPhotometricInterpretation, typeShort, []uint32{m.photometric}},
+		{tagSamplesPerPixel, typeShort, []uint32{uint32(m.samples)}},
+	} {
+		fields[f.tag] = f
+	}
+	if m.tileWidth > 0 {
+		fields[tagTileWidth] = testField{tagTileWidth, typeShort, []uint32{uint32(m.tileWidth)}}
+		fields[tagTileLength] = testField{tagTileLength, typeLong, []uint32{uint32(m.tileLength)}}
+		fields[tagTileOffsets] = testField{tagTileOffsets, offsetType, offsets}
+		fields[tagTileByteCounts] = testField{tagTileByteCounts, offsetType, counts}
+	} else {
+		fields[tagStripOffsets] = testField{tagStripOffsets, offsetType, offsets}
+		fields[tagRowsPerStrip] = testField{tagRowsPerStrip, typeShort, []uint32{uint32(m.rowsPerStrip)}}
+		fields[tagStripByteCounts] = testField{tagStripByteCounts, offsetType, counts}
+	}
+	if m.predictor != 0 {
+		fields[tagPredictor] = testField{tagPredictor, typeShort, []uint32{m.predictor}}
+	}
+	if m.extra != nil {
+		fields[tagExtraSamples] = testField{tagExtraSamples, typeShort, m.extra}
+	}
+	if m.colorMap != nil {
+		fields[tagColorMap] = testField{tagColorMap, typeShort, m.colorMap}
+	}
+	for _, f := range extra {
+		fields[f.tag] = f
+	}
+	off := len(b) + len(b)&1
+	return putTestIFD(b, bo, m.bigTIFF, off, fields), off
+}
+
+// blocks returns the uncompressed strips or tiles of the image, and the number
+// of bytes in their rows. Tiles are padded with zeroes past the edges of the
+// image.
+func (m *baselineImage) blocks() ([][]byte, int) {
+	rowBytes := m.rowBytes()
+	var blocks [][]byte
+	if m.tileWidth == 0 {
+		for from := 0; from < m.height; from += m.rowsPerStrip {
+			to := from + m.rowsPerStrip
+			if to > m.height {
+				to = m.height
+			}
+			blocks = append(blocks, append([]byte{}, m.pix[from*rowBytes:to*rowBytes]...))
+		}
+		return blocks, rowBytes
+	}
+	tileRowBytes := m.tileWidth * m.samples * m.bits / 8
+	for y0 := 0; y0 < m.height; y0 += m.tileLength {
+		for x0 := 0; x0 < rowBytes; x0 += tileRowBytes {
+			tile := make([]byte, m.tileLength*tileRowBytes)
+			for y := y0; y < y0+m.tileLength && y < m.height; y++ {
+				row := m.pix[y*rowBytes : (y+1)*rowBytes]
+				copy(tile[(y-y0)*tileRowBytes:(y-y0+1)*tileRowBytes], row[x0:])
+			}
+			blocks = append(blocks, tile)
+		}
+	}
+	return blocks, tileRowBytes
+}
+
+// compressStrip compresses the rows of a strip or tile.
+func compressStrip(data []byte, rowBytes int, compression uint32) []byte {
+	switch compression {
+	case compressionPackBits:
+		var res []byte
+		for i := 0; i < len(data); i += rowBytes {
+			res = appendPackBits(res, data[i:i+rowBytes])
+		}
+		return res
+	case compressionLZW:
+		return encodeLZW(data)
+	case compressionDeflate:
+		var b bytes.Buffer
+		w := zlib.NewWriter(&b)
+		w.Write(data)
+		w.Close()
+		return b.Bytes()
+	}
+	return data
+}
+
+// predict applies horizontal differencing to a row, see unpredict.
+func predict(row []byte, samples, bits int, bo binary.ByteOrder) {
+	if bits == 8 {
+		for i := len(row) - 1; i >= samples; i-- {
+			row[i] -= row[i-samples]
+		}
+		return
+	}
+	for i := len(row) - 2; i >= 2*samples; i -= 2 {
+		bo.PutUint16(row[i:], bo.Uint16(row[i:])-bo.Uint16(row[i-2*samples:]))
+	}
+}
+
+// encodeLZW encodes data with TIFF flavored LZW. For simplicity, only literal
+// codes are written, and the code table is cleared before it grows past 9-bit
+// codes.
+func encodeLZW(data []byte) []byte {
+	const (
+		clear = 256
+		eoi   = 257
+	)
+	var res []byte
+	var acc uint32
+	var bits int
+	write := func(code uint32) {
+		acc = acc<<9 | code
+		bits += 9
+		for bits >= 8 {
+			res = append(res, byte(acc>>(bits-8)))
+			bits -= 8
+		}
+	}
+	for i, b := range data {
+		if i%250 == 0 {
+			write(clear)
+		}
+		write(uint32(b))
+	}
+	write(eoi)
+	if bits > 0 {
+		res = append(res, byte(acc<<(8-bits)))
+	}
+	return res
+}
+
+// appendPackBits appends the PackBits encoding of row to b. Runs of 3 or more
+// bytes are encoded as runs, and other bytes as literals.
+func appendPackBits(b, row []byte) []byte {
+	for i := 0; i < len(row); {
+		n := 1
+		for i+n < len(row) && n < 128 && row[i+n] == row[i] {
+			n++
+		}
+		if n >= 3 {
+			b = append(b, byte(int8(1-n)), row[i])
+			i += n
+			continue
+		}
+		j := i
+		for j < len(row) && j-i < 128 {
+			if j+2 < len(row) && row[j] == row[j+1] && row[j] == row[j+2] {
+				break
+			}
+			j++
+		}
+		b = append(b, byte(j-i-1))
+		b = append(b, row[i:j]...)
+		i = j
+	}
+	return b
+}
+
+func TestLZW(t *testing.T) {
+	data := make([]byte, 2000)
+	rand.Read(data)
+	r, err := decompress(bytes.NewReader(encodeLZW(data)), compressionLZW)
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+func TestPackBitsReader(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		m := baselineImage{width: 1 + rand.Intn(500), height: 1, samples: 1, bits: 8}
+		m.randPix()
+		r, err := decompress(bytes.NewReader(appendPackBits(nil, m.pix)), compressionPackBits)
+		require.NoError(t, err)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, m.pix, got)
+	}
+
+	// A run that is cut short
+	r, err := decompress(bytes.NewReader([]byte{2, 1, 2}), compressionPackBits)
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
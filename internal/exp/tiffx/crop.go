@@ -0,0 +1,167 @@
+package tiffx
+
+import (
+	"errors"
+	"image"
+	"io"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// Crop crops the provided region of the TIFF found in the input stream to the
+// output stream. The input must be in the strict profile, see DecodeHeader, and
+// the cropped image is written in the same profile.
+//
+// Like bmpx.Crop, pixels are copied from the input to the output as-is, so crop
+// uses a very small amount of memory (~KiB). If src is an io.ReadSeeker, then
+// the cropper will seek to skip pixels that are outside the cropping region.
+//
+// See CropAt for cropping other TIFF layouts.
+func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
+	hdr, err := DecodeHeader(src)
+	if err != nil {
+		return err
+	}
+
+	// Find / validate crop area
+	dim := image.Rect(0, 0, hdr.Config.Width, hdr.Config.Height)
+	region = dim.Intersect(region)
+	if region.Empty() {
+		return errors.New("crop area empty or out of bounds")
+	}
+
+	err = writeHeader(dst, region.Dx(), region.Dy(), hdr.Premultiplied, nil)
+	if err != nil {
+		return err
+	}
+
+	// Rows are stored top-down without padding, so the region is found by
+	// skipping whole rows followed by the pixels left of the region. Skipping
+	// right of the region and left of the region on the next row is done in
+	// one go.
+	seek := ioutilx.Skipper(src)
+	pixelBytes := hdr.BitsPerPixel / 8
+	rowBytes := hdr.Config.Width * pixelBytes
+	left := region.Min.X * pixelBytes
+	mid := region.Dx() * pixelBytes
+	if _, err := seek(region.Min.Y*rowBytes + left); err != nil {
+		return err
+	}
+	for dy := 0; dy < region.Dy(); dy++ {
+		if dy > 0 {
+			if _, err := seek(rowBytes - mid); err != nil {
+				return err
+			}
+		}
+		n, err := io.CopyN(dst, src, int64(mid))
+		if err != nil || n != int64(mid) {
+			return err
+		}
+	}
+	return nil
+}
+
+// CropAt crops the provided region of the first image of the TIFF in src to
+// the output stream, as a TIFF in the strict profile.
+//
+// Unlike Crop, the input may be any baseline TIFF supported by Convert, such as
+// images that are stored in many strips or tiles, compressed, or that have
+// their IFD at the end of the file. Only strips and tiles that intersect the
+// region are read, so the cost of a crop depends on the size of the region and
+// its strips rather than the position of the region in the image. Memory use
+// is bounded by the IFD and two rows of the image, or one row of tiles.
+//
+// See CropAtWithOptions for cropping other pages of multi-page and pyramidal
+// TIFFs.
+func CropAt(src io.ReaderAt, dst io.Writer, region image.Rectangle) error {
+	return CropAtWithOptions(src, dst, region, nil)
+}
+
+// Options holds options for CropAtWithOptions.
+type Options struct {
+	// Page is the index of the page to crop, see Pages. The region is given in
+	// the coordinates of this page.
+	Page int
+
+	// Size selects a pyramid level of the page to crop from. When set, the
+	// region is cropped from the smallest level in which it spans at least
+	// Size pixels, and its coordinates are scaled from the page to the level.
+	// The cropped image has the size of the scaled region, which may be larger
+	// than Size. If no level is small enough, the page itself is cropped.
+	//
+	// Levels are pages with the same aspect ratio as the page, up to rounding,
+	// that are smaller than the page.
+	Size image.Point
+
+	// Metadata lists tags of the cropped page that are copied to the cropped
+	// image, such as TagXResolution or TagICCProfile. Tags that describe the
+	// layout of the image, and tags of IFD type, which point to other
+	// structures of the file, are never copied. Nor are tags of types that
+	// are not part of the TIFF or BigTIFF specifications.
+	//
+	// Georeferencing is adjusted for the offset of the region, so that
+	// ModelTiepoint and ModelTransformation map the pixels of the cropped image
+	// to the same model coordinates as in the page. When a pyramid level is
+	// cropped, its own tags are copied.
+	Metadata []uint16
+
+	// AllMetadata copies all tags of the cropped page, except those that
+	// describe the layout of the image, as if they were listed in Metadata.
+	AllMetadata bool
+}
+
+// CropAtWithOptions is CropAt with options for selecting the page or pyramid
+// level to crop, and for copying metadata to the cropped image. A nil opts
+// crops the first page without metadata.
+func CropAtWithOptions(src io.ReaderAt, dst io.Writer, region image.Rectangle, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if opts.Page < 0 || opts.Page >= maxPages {
+		return errors.New("page out of range")
+	}
+
+	// Only the IFDs up to the page are read, unless all levels are needed
+	n := opts.Page + 1
+	if opts.Size != (image.Point{}) {
+		n = -1
+	}
+	dirs, pages, err := readPages(src, n)
+	if err != nil {
+		return err
+	}
+	if opts.Page >= len(pages) {
+		return errors.New("page out of range")
+	}
+	page := pages[opts.Page]
+	region = image.Rect(0, 0, page.Width, page.Height).Intersect(region)
+	if region.Empty() {
+		return errors.New("crop area empty or out of bounds")
+	}
+	i := opts.Page
+	if opts.Size != (image.Point{}) {
+		i = pyramidLevel(dirs, pages, opts.Page, region, opts.Size)
+		region = scaleRegion(region, page, pages[i])
+	}
+	l, err := newLayout(dirs[i])
+	if err != nil {
+		return err
+	}
+	dim := image.Rect(0, 0, l.width, l.height)
+	region = dim.Intersect(region)
+	if region.Empty() {
+		return errors.New("crop area empty or out of bounds")
+	}
+	meta, err := metadata(dirs[i], opts, region.Min)
+	if err != nil {
+		return err
+	}
+	enc, err := newEncoder(dst, region.Dx(), region.Dy(), l.premultiplied, meta)
+	if err != nil {
+		return err
+	}
+	if err := l.cropRows(src, region, enc.WriteRow); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,215 @@
+package tiffx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+)
+
+func TestCrop(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		w := 1 + rand.Intn(100)
+		h := 1 + rand.Intn(100)
+		img := randNRGBA(w, h)
+		bo := binary.ByteOrder(binary.LittleEndian)
+		if i%2 == 1 {
+			bo = binary.BigEndian
+		}
+		b := encodeStrict(bo, i%5 == 0, w, h, nil, img.Pix)
+		region := randRegion(w, h)
+
+		// Seeking and streaming input
+		var src io.Reader = bytes.NewReader(b)
+		if i%3 == 0 {
+			src = struct{ io.Reader }{src}
+		}
+		var cropped bytes.Buffer
+		err := Crop(src, &cropped, region)
+		require.NoError(t, err)
+
+		// The output is in the strict profile
+		hdr, err := DecodeHeader(bytes.NewReader(cropped.Bytes()))
+		require.NoError(t, err)
+		require.Equal(t, region.Dx(), hdr.Config.Width)
+		require.Equal(t, region.Dy(), hdr.Config.Height)
+		require.Equal(t, int(hdr.ImageOffset+hdr.ImageByteCount), cropped.Len())
+
+		got, err := tiff.Decode(&cropped)
+		require.NoError(t, err)
+		requireImageEqual(t, img.SubImage(region), got)
+	}
+}
+
+func TestCropOutOfBounds(t *testing.T) {
+	img := randNRGBA(10, 10)
+	b := encodeStrict(binary.LittleEndian, false, 10, 10, nil, img.Pix)
+	err := Crop(bytes.NewReader(b), io.Discard, image.Rect(10, 0, 20, 10))
+	require.Error(t, err)
+}
+
+// randRegion returns a random non-empty region within a w by h image.
+func randRegion(w, h int) image.Rectangle {
+	x0, y0 := rand.Intn(w), rand.Intn(h)
+	x1, y1 := x0+1+rand.Intn(w-x0), y0+1+rand.Intn(h-y0)
+	return image.Rect(x0, y0, x1, y1)
+}
+
+// requireImageEqual requires the pixels of want and got to be equal, where
+// want may be a sub-image that does not start at the origin.
+func requireImageEqual(t *testing.T, want, got image.Image) {
+	t.Helper()
+	wb, gb := want.Bounds(), got.Bounds()
+	require.Equal(t, wb.Size(), gb.Size())
+	for y := 0; y < wb.Dy(); y++ {
+		for x := 0; x < wb.Dx(); x++ {
+			wc := color.NRGBAModel.Convert(want.At(wb.Min.X+x, wb.Min.Y+y))
+			gc := color.NRGBAModel.Convert(got.At(gb.Min.X+x, gb.Min.Y+y))
+			require.Equal(t, wc, gc, "pixel (%v, %v)", x, y)
+		}
+	}
+}
+
+func TestCropAt(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		m := baselineImage{
+			width:       1 + rand.Intn(60),
+			height:      1 + rand.Intn(60),
+			photometric: photometricRGB,
+			bits:        8,
+			samples:     3,
+			compression: []uint32{compressionNone, compressionPackBits, compressionLZW, compressionDeflate}[i%4],
+		}
+		if i%4 == 0 {
+			m.photometric, m.bits, m.samples = photometricBlackIsZero, 1+rand.Intn(2)*3, 1
+		}
+		if m.compression != compressionNone && m.bits == 8 && i%3 == 0 {
+			m.predictor = predictorHorizontal
+		}
+		m.rowsPerStrip = 1 + rand.Intn(m.height)
+		m.randPix()
+		bo := binary.ByteOrder(binary.LittleEndian)
+		if i%2 == 1 {
+			bo = binary.BigEndian
+		}
+		src := encodeBaseline(bo, m)
+		region := randRegion(m.width, m.height)
+
+		// Record the reads of strips
+		r := &readRecorder{r: bytes.NewReader(src)}
+		var dst bytes.Buffer
+		err := CropAt(r, &dst, region)
+		require.NoError(t, err)
+
+		rd := bytes.NewReader(dst.Bytes())
+		hdr, err := DecodeHeader(rd)
+		require.NoError(t, err)
+		require.Equal(t, region.Size(), image.Pt(hdr.Config.Width, hdr.Config.Height))
+		got, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, cropRGBA(m.rgba(bo), m.width, region), got, "region %v", region)
+
+		// Strips are written in reverse order after the header, so strips
+		// outside of the region are found between the offsets of the first and
+		// last strips of the region.
+		first := region.Min.Y / m.rowsPerStrip
+		last := (region.Max.Y - 1) / m.rowsPerStrip
+		l, err := readLayout(bytes.NewReader(src))
+		require.NoError(t, err)
+		lo := int64(l.offsets[last])
+		hi := int64(l.offsets[first] + l.counts[first])
+		for _, rr := range r.reads {
+			if rr[0] < int64(l.offsets[0]+l.counts[0]) && rr[1] > headerLen {
+				require.True(t, rr[0] >= lo && rr[1] <= hi, "read %v outside of strips [%v, %v)", rr, lo, hi)
+			}
+		}
+	}
+}
+
+func TestCropAtTiled(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		m := baselineImage{
+			width:       1 + rand.Intn(100),
+			height:      1 + rand.Intn(100),
+			photometric: photometricRGB,
+			bits:        8,
+			samples:     3,
+			tileWidth:   16 * (1 + rand.Intn(3)),
+			tileLength:  1 + rand.Intn(40),
+			compression: []uint32{compressionNone, compressionPackBits, compressionLZW, compressionDeflate}[i%4],
+		}
+		if i%4 == 0 {
+			m.photometric, m.bits, m.samples = photometricBlackIsZero, 1+rand.Intn(2)*3, 1
+		}
+		if m.compression != compressionNone && m.bits == 8 && i%3 == 0 {
+			m.predictor = predictorHorizontal
+		}
+		m.randPix()
+		bo := binary.ByteOrder(binary.LittleEndian)
+		if i%2 == 1 {
+			bo = binary.BigEndian
+		}
+		src := encodeBaseline(bo, m)
+		region := randRegion(m.width, m.height)
+
+		r := &readRecorder{r: bytes.NewReader(src)}
+		var dst bytes.Buffer
+		err := CropAt(r, &dst, region)
+		require.NoError(t, err)
+
+		rd := bytes.NewReader(dst.Bytes())
+		_, err = DecodeHeader(rd)
+		require.NoError(t, err)
+		got, err := io.ReadAll(rd)
+		require.NoError(t, err)
+		require.Equal(t, cropRGBA(m.rgba(bo), m.width, region), got, "region %v", region)
+
+		// Reads of image data must be within tiles that intersect the region
+		l, err := readLayout(bytes.NewReader(src))
+		require.NoError(t, err)
+		across := (m.width + m.tileWidth - 1) / m.tileWidth
+		for _, rr := range r.reads {
+			if rr[0] >= int64(l.offsets[0]+l.counts[0]) || rr[1] <= headerLen {
+				continue
+			}
+			var ok bool
+			for j, off := range l.offsets {
+				tile := image.Rect(j%across, j/across, j%across+1, j/across+1)
+				tile.Min.X, tile.Max.X = tile.Min.X*m.tileWidth, tile.Max.X*m.tileWidth
+				tile.Min.Y, tile.Max.Y = tile.Min.Y*m.tileLength, tile.Max.Y*m.tileLength
+				if rr[0] >= int64(off) && rr[1] <= int64(off+l.counts[j]) {
+					ok = tile.Overlaps(region)
+					break
+				}
+			}
+			require.True(t, ok, "read %v outside of tiles that intersect %v", rr, region)
+		}
+	}
+}
+
+// readRecorder records the byte ranges that are read from r.
+type readRecorder struct {
+	r     io.ReaderAt
+	reads [][2]int64
+}
+
+func (r *readRecorder) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(p, off)
+	r.reads = append(r.reads, [2]int64{off, off + int64(n)})
+	return n, err
+}
+
+// cropRGBA crops the region of RGBA pixels of an image with the provided width.
+func cropRGBA(pix []byte, width int, region image.Rectangle) []byte {
+	var res []byte
+	for y := region.Min.Y; y < region.Max.Y; y++ {
+		res = append(res, pix[4*(y*width+region.Min.X):4*(y*width+region.Max.X)]...)
+	}
+	return res
+}
@@ -0,0 +1,186 @@
+package tiffx
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// Encoder writes a TIFF in the strict profile, see DecodeHeader, one row at a
+// time. Since the size of the image data is known upfront, the header is
+// written first and rows are written directly to the output stream as they
+// arrive, so memory use does not depend on the size of the image.
+type Encoder struct {
+	w        io.Writer
+	rowBytes int
+	rows     int // Number of rows left to write
+}
+
+// NewEncoder writes the header of a TIFF with the provided dimensions to w,
+// and returns an encoder for its rows.
+//
+// The color model of cfg selects how alpha is stored. color.RGBAModel means
+// that rows hold premultiplied RGBA pixels, and color.NRGBAModel or nil means
+// that they hold non-premultiplied RGBA pixels.
+func NewEncoder(w io.Writer, cfg image.Config) (*Encoder, error) {
+	var premultiplied bool
+	switch cfg.ColorModel {
+	case nil, color.NRGBAModel:
+	case color.RGBAModel:
+		premultiplied = true
+	default:
+		return nil, errors.New("unsupported color model")
+	}
+	return newEncoder(w, cfg.Width, cfg.Height, premultiplied, nil)
+}
+
+// newEncoder writes the header of a TIFF with the provided dimensions and
+// metadata to w, see writeHeader, and returns an encoder for its rows.
+func newEncoder(w io.Writer, width, height int, premultiplied bool, meta []field) (*Encoder, error) {
+	if err := writeHeader(w, width, height, premultiplied, meta); err != nil {
+		return nil, err
+	}
+	return &Encoder{w: w, rowBytes: width * 4, rows: height}, nil
+}
+
+// WriteRow writes the next row of the image, top to bottom. The row holds 8-bit
+// red, green, blue and alpha samples for each pixel.
+func (e *Encoder) WriteRow(row []byte) error {
+	if len(row) != e.rowBytes {
+		return errors.New("invalid row length")
+	}
+	if e.rows == 0 {
+		return errors.New("all rows have been written")
+	}
+	e.rows--
+	_, err := e.w.Write(row)
+	return err
+}
+
+// Close checks that all rows of the image have been written. It does not close
+// the underlying writer.
+func (e *Encoder) Close() error {
+	if e.rows > 0 {
+		return errors.New("missing rows")
+	}
+	return nil
+}
+
+// Encode writes img to w as a TIFF in the strict profile. An *image.RGBA is
+// written with premultiplied alpha, all other images are converted to
+// non-premultiplied RGBA.
+func Encode(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	cfg := image.Config{ColorModel: color.NRGBAModel, Width: b.Dx(), Height: b.Dy()}
+	if _, ok := img.(*image.RGBA); ok {
+		cfg.ColorModel = color.RGBAModel
+	}
+	enc, err := NewEncoder(w, cfg)
+	if err != nil {
+		return err
+	}
+	row := make([]byte, 4*b.Dx())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		switch m := img.(type) {
+		case *image.NRGBA:
+			copy(row, m.Pix[m.PixOffset(b.Min.X, y):])
+		case *image.RGBA:
+			copy(row, m.Pix[m.PixOffset(b.Min.X, y):])
+		default:
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				i := 4 * (x - b.Min.X)
+				row[i+0], row[i+1], row[i+2], row[i+3] = c.R, c.G, c.B, c.A
+			}
+		}
+		if err := enc.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return enc.Close()
+}
+
+// writeHeader writes the header of a little-endian TIFF in the strict profile
+// for an image with the provided dimensions to w, with any metadata fields
+// added to the IFD. The metadata must be little-endian and may not hold any of
+// the fields that describe the image.
+//
+// The image is stored at ImageOffset, or at the next multiple of ImageOffset
+// if the metadata does not fit before it. Files that would be larger than 4GiB
+// are written as BigTIFF.
+func writeHeader(w io.Writer, width, height int, premultiplied bool, meta []field) error {
+	if width <= 0 || height <= 0 || width > 1<<30 || height > 1<<30 {
+		return errors.New("unsupported image dimensions")
+	}
+	size := uint64(width) * uint64(height) * 4
+	bo := binary.LittleEndian
+	extra := uint16(extraSamplesUnassociated)
+	if premultiplied {
+		extra = extraSamplesAssociated
+	}
+	var big bool
+	for _, f := range meta {
+		// 64-bit fields are only valid in BigTIFF
+		big = big || f.Type >= typeLong8
+	}
+
+	// The size of the IFD decides the image offset, which in turn decides
+	// whether the file is a BigTIFF, which has a larger IFD.
+	var fields []field
+	imageOffset := ImageOffset
+	for {
+		byteCounts := longField(bo, tagStripByteCounts, uint32(size))
+		if big {
+			byteCounts = long8Field(bo, tagStripByteCounts, size)
+		}
+		fields = append([]field{
+			longField(bo, tagImageWidth, uint32(width)),
+			longField(bo, tagImageLength, uint32(height)),
+			shortField(bo, tagBitsPerSample, 8, 8, 8, 8),
+			shortField(bo, tagCompression, compressionNone),
+			shortField(bo, tagPhotometricInterpretation, photometricRGB),
+			longField(bo, tagStripOffsets, uint32(imageOffset)),
+			shortField(bo, tagSamplesPerPixel, 4),
+			longField(bo, tagRowsPerStrip, uint32(height)),
+			byteCounts,
+			shortField(bo, tagPlanarConfiguration, planarChunky),
+			shortField(bo, tagExtraSamples, extra),
+		}, meta...)
+		sort.SliceStable(fields, func(i, j int) bool {
+			return fields[i].Tag < fields[j].Tag
+		})
+		n := headerLen
+		if big {
+			n = bigHeaderLen
+		}
+		n += ifdLen(big, fields)
+		n = (n + ImageOffset - 1) / ImageOffset * ImageOffset
+		if n > maxImageOffset {
+			return errors.New("unsupported: metadata too large")
+		}
+		nbig := big || uint64(n)+size > 1<<32-1
+		if n == imageOffset && nbig == big {
+			break
+		}
+		imageOffset, big = n, nbig
+	}
+
+	b := make([]byte, imageOffset)
+	off := headerLen
+	if big {
+		copy(b, "II\x2B\x00\x08\x00\x00\x00")
+		bo.PutUint64(b[8:16], bigHeaderLen)
+		off = bigHeaderLen
+	} else {
+		copy(b, "II\x2A\x00")
+		bo.PutUint32(b[4:8], headerLen)
+	}
+	if _, err := putIFD(b, bo, big, off, fields, 0); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
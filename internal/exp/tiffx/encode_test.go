@@ -0,0 +1,76 @@
+package tiffx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+)
+
+func TestEncode(t *testing.T) {
+	nrgba := randNRGBA(31, 17)
+	rgba := image.NewRGBA(nrgba.Rect)
+	draw.Draw(rgba, rgba.Rect, nrgba, image.Point{}, draw.Src)
+	gray := image.NewGray(nrgba.Rect)
+	draw.Draw(gray, gray.Rect, nrgba, image.Point{}, draw.Src)
+	sub := nrgba.SubImage(image.Rect(3, 5, 20, 9))
+
+	for _, tc := range []struct {
+		name          string
+		img           image.Image
+		premultiplied bool
+	}{
+		{"nrgba", nrgba, false},
+		{"rgba", rgba, true},
+		{"gray", gray, false},
+		{"sub-image", sub, false},
+	} {
+		var b bytes.Buffer
+		require.NoError(t, Encode(&b, tc.img), tc.name)
+
+		hdr, err := DecodeHeader(bytes.NewReader(b.Bytes()))
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.img.Bounds().Dx(), hdr.Config.Width, tc.name)
+		require.Equal(t, tc.img.Bounds().Dy(), hdr.Config.Height, tc.name)
+		require.Equal(t, tc.premultiplied, hdr.Premultiplied, tc.name)
+		require.Equal(t, int(hdr.ImageOffset+hdr.ImageByteCount), b.Len(), tc.name)
+
+		got, err := tiff.Decode(&b)
+		require.NoError(t, err, tc.name)
+		requireImageEqual(t, tc.img, got)
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var b bytes.Buffer
+	enc, err := NewEncoder(&b, image.Config{Width: 3, Height: 2})
+	require.NoError(t, err)
+	require.Error(t, enc.WriteRow(make([]byte, 11)))
+	rows := make([]byte, 24)
+	rand.Read(rows)
+	require.NoError(t, enc.WriteRow(rows[:12]))
+	require.Error(t, enc.Close())
+	require.NoError(t, enc.WriteRow(rows[12:]))
+	require.Error(t, enc.WriteRow(rows[12:]))
+	require.NoError(t, enc.Close())
+	require.Equal(t, rows, b.Bytes()[ImageOffset:])
+
+	// Images larger than 4GiB are written as BigTIFF
+	b.Reset()
+	_, err = NewEncoder(&b, image.Config{Width: 1 << 15, Height: 1 << 15})
+	require.NoError(t, err)
+	hdr, err := DecodeHeader(&b)
+	require.NoError(t, err)
+	require.True(t, hdr.BigTIFF)
+	require.Equal(t, uint64(1<<32), hdr.ImageByteCount)
+
+	_, err = NewEncoder(&b, image.Config{ColorModel: color.GrayModel, Width: 3, Height: 2})
+	require.Error(t, err)
+	_, err = NewEncoder(&b, image.Config{Width: 0, Height: 2})
+	require.Error(t, err)
+}
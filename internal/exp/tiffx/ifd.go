@@ -0,0 +1,437 @@
+package tiffx
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// Tags used by this package.
+const (
+	tagImageWidth                = 256
+	tagImageLength               = 257
+	tagBitsPerSample             = 258
+	tagCompression               = 259
+	tagPhotometricInterpretation = 262
+	tagStripOffsets              = 273
+	tagSamplesPerPixel           = 277
+	tagRowsPerStrip              = 278
+	tagStripByteCounts           = 279
+	tagPlanarConfiguration       = 284
+	tagPredictor                 = 317
+	tagColorMap                  = 320
+	tagTileWidth                 = 322
+	tagTileLength                = 323
+	tagTileOffsets               = 324
+	tagTileByteCounts            = 325
+	tagSubIFDs                   = 330
+	tagExtraSamples              = 338
+)
+
+// Field types.
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeSByte     = 6
+	typeUndefined = 7
+	typeSShort    = 8
+	typeSLong     = 9
+	typeSRational = 10
+	typeFloat     = 11
+	typeDouble    = 12
+	typeIFD       = 13
+	typeLong8     = 16 // BigTIFF only
+	typeSLong8    = 17 // BigTIFF only
+	typeIFD8      = 18 // BigTIFF only
+)
+
+// typeLen holds the length in bytes of a single value of each field type.
+var typeLen = [...]int{
+	typeByte:      1,
+	typeASCII:     1,
+	typeShort:     2,
+	typeLong:      4,
+	typeRational:  8,
+	typeSByte:     1,
+	typeUndefined: 1,
+	typeSShort:    2,
+	typeSLong:     4,
+	typeSRational: 8,
+	typeFloat:     4,
+	typeDouble:    8,
+	typeIFD:       4,
+	typeLong8:     8,
+	typeSLong8:    8,
+	typeIFD8:      8,
+}
+
+// Values of the Compression tag.
+const (
+	compressionNone       = 1
+	compressionLZW        = 5
+	compressionDeflate    = 8
+	compressionPackBits   = 32773
+	compressionDeflateOld = 32946
+)
+
+// Values of the Predictor tag.
+const (
+	predictorNone       = 1
+	predictorHorizontal = 2
+)
+
+// Values of the PhotometricInterpretation tag.
+const (
+	photometricWhiteIsZero = 0
+	photometricBlackIsZero = 1
+	photometricRGB         = 2
+	photometricPaletted    = 3
+)
+
+// Values of the PlanarConfiguration tag.
+const (
+	planarChunky = 1
+)
+
+// Values of the ExtraSamples tag.
+const (
+	extraSamplesUnspecified  = 0
+	extraSamplesAssociated   = 1 // Premultiplied alpha
+	extraSamplesUnassociated = 2
+)
+
+const (
+	headerLen   = 8  // Length of the file header in bytes.
+	ifdEntryLen = 12 // Length of an IFD entry in bytes.
+
+	bigHeaderLen   = 16 // Length of the BigTIFF file header in bytes.
+	bigIFDEntryLen = 20 // Length of a BigTIFF IFD entry in bytes.
+)
+
+// field is an entry of an IFD.
+type field struct {
+	Tag   uint16
+	Type  uint16
+	Count uint32
+
+	// Value holds the values of the field in the byte order of the file.
+	Value []byte
+}
+
+// uint returns the i'th value of an unsigned integer field.
+func (f field) uint(bo binary.ByteOrder, i int) uint64 {
+	switch f.Type {
+	case typeByte, typeUndefined:
+		return uint64(f.Value[i])
+	case typeShort:
+		return uint64(bo.Uint16(f.Value[2*i:]))
+	case typeLong, typeIFD:
+		return uint64(bo.Uint32(f.Value[4*i:]))
+	case typeLong8, typeIFD8:
+		return bo.Uint64(f.Value[8*i:])
+	}
+	panic("not an unsigned integer field")
+}
+
+// header is the file header of a TIFF.
+type header struct {
+	bo  binary.ByteOrder
+	big bool  // BigTIFF, with 64-bit offsets and counts
+	ifd int64 // Offset of the first IFD
+}
+
+// parseHeader parses the file header at the start of b, which holds at least
+// the 16 bytes of a BigTIFF header.
+func parseHeader(b []byte) (header, error) {
+	var h header
+	switch string(b[0:2]) {
+	case "II":
+		h.bo = binary.LittleEndian
+	case "MM":
+		h.bo = binary.BigEndian
+	default:
+		return h, errors.New("unsupported binary format")
+	}
+	switch h.bo.Uint16(b[2:4]) {
+	case 42:
+		h.ifd = int64(h.bo.Uint32(b[4:8]))
+	case 43:
+		// Offsets are 8 bytes, followed by 2 reserved bytes
+		if h.bo.Uint16(b[4:6]) != 8 || h.bo.Uint16(b[6:8]) != 0 {
+			return h, errors.New("unsupported BigTIFF offset size")
+		}
+		h.big = true
+		h.ifd = int64(h.bo.Uint64(b[8:16]))
+		if h.ifd < 0 {
+			return h, errors.New("invalid IFD offset")
+		}
+	default:
+		return h, errors.New("unsupported binary format")
+	}
+	return h, nil
+}
+
+// ifd is an image file directory.
+type ifd struct {
+	bo     binary.ByteOrder
+	fields []field // sorted by tag
+	next   uint64  // offset of the next IFD, or 0
+}
+
+// readIFD reads the IFD at offset off of the TIFF in r with header h. Values
+// that do not fit in an entry are read from their offsets in r.
+func readIFD(r io.ReaderAt, h header, off int64) (ifd, error) {
+	res := ifd{bo: h.bo}
+	bo := h.bo
+
+	// Classic TIFF has a 2-byte entry count, 12-byte entries with 4-byte
+	// counts and values, and a 4-byte next offset. BigTIFF uses 8 bytes for
+	// all of them.
+	countLen, entryLen, valueLen := 2, ifdEntryLen, 4
+	if h.big {
+		countLen, entryLen, valueLen = 8, bigIFDEntryLen, 8
+	}
+	var b [8]byte
+	if err := ioutilx.ReadFullAt(r, b[:countLen], off); err != nil {
+		return res, err
+	}
+	var n int
+	if h.big {
+		if v := bo.Uint64(b[:]); v <= 1<<16 {
+			n = int(v)
+		} else {
+			return res, errors.New("IFD has too many entries")
+		}
+	} else {
+		n = int(bo.Uint16(b[:2]))
+	}
+	entries := make([]byte, n*entryLen+valueLen)
+	if err := ioutilx.ReadFullAt(r, entries, off+int64(countLen)); err != nil {
+		return res, err
+	}
+	res.fields = make([]field, 0, n)
+	for i := 0; i < n; i++ {
+		e := entries[i*entryLen : (i+1)*entryLen]
+		f := field{
+			Tag:  bo.Uint16(e[0:2]),
+			Type: bo.Uint16(e[2:4]),
+		}
+		if f.Type == 0 || int(f.Type) >= len(typeLen) || typeLen[f.Type] == 0 ||
+			(!h.big && f.Type >= typeLong8) {
+			// Readers should ignore fields of unknown types, but the layout
+			// of the image can not be read without its structural fields
+			if structuralTags[f.Tag] {
+				return res, errors.New("invalid IFD entry type")
+			}
+			continue
+		}
+		value := e[8:]
+		count := uint64(bo.Uint32(e[4:8]))
+		if h.big {
+			value = e[12:]
+			count = bo.Uint64(e[4:12])
+		}
+		if count > maxFieldLen {
+			return res, errors.New("IFD entry too large")
+		}
+		f.Count = uint32(count)
+		size := int64(f.Count) * int64(typeLen[f.Type])
+		if size <= int64(valueLen) {
+			f.Value = append([]byte{}, value[:size]...)
+		} else {
+			if size > maxFieldLen {
+				return res, errors.New("IFD entry too large")
+			}
+			valueOffset := int64(bo.Uint32(value))
+			if h.big {
+				valueOffset = int64(bo.Uint64(value))
+			}
+			f.Value = make([]byte, size)
+			if err := ioutilx.ReadFullAt(r, f.Value, valueOffset); err != nil {
+				return res, err
+			}
+		}
+		res.fields = append(res.fields, f)
+	}
+	sort.SliceStable(res.fields, func(i, j int) bool {
+		return res.fields[i].Tag < res.fields[j].Tag
+	})
+	if h.big {
+		res.next = bo.Uint64(entries[n*entryLen:])
+	} else {
+		res.next = uint64(bo.Uint32(entries[n*entryLen:]))
+	}
+	return res, nil
+}
+
+// maxFieldLen is the maximum length of the values of a single field. It guards
+// against allocating huge buffers for corrupt files.
+const maxFieldLen = 64 << 20
+
+// field returns the field with the provided tag.
+func (d ifd) field(tag uint16) (field, bool) {
+	i := sort.Search(len(d.fields), func(i int) bool {
+		return d.fields[i].Tag >= tag
+	})
+	if i < len(d.fields) && d.fields[i].Tag == tag {
+		return d.fields[i], true
+	}
+	return field{}, false
+}
+
+// uint64s returns the values of an unsigned integer field. Offsets and byte
+// counts of BigTIFF files are stored in 64-bit fields.
+func (d ifd) uint64s(tag uint16) ([]uint64, error) {
+	f, ok := d.field(tag)
+	if !ok {
+		return nil, nil
+	}
+	switch f.Type {
+	case typeByte, typeShort, typeLong, typeLong8, typeIFD, typeIFD8:
+	default:
+		return nil, errors.New("invalid IFD entry type")
+	}
+	res := make([]uint64, f.Count)
+	for i := range res {
+		res[i] = f.uint(d.bo, i)
+	}
+	return res, nil
+}
+
+// uints returns the values of an unsigned integer field, which must fit in 32
+// bits.
+func (d ifd) uints(tag uint16) ([]uint32, error) {
+	vals, err := d.uint64s(tag)
+	if err != nil {
+		return nil, err
+	}
+	var res []uint32
+	if vals != nil {
+		res = make([]uint32, len(vals))
+	}
+	for i, v := range vals {
+		if v > 1<<32-1 {
+			return nil, errors.New("IFD entry value out of range")
+		}
+		res[i] = uint32(v)
+	}
+	return res, nil
+}
+
+// uint returns the single value of an unsigned integer field, or def if the
+// field is missing.
+func (d ifd) uint(tag uint16, def uint32) (uint32, error) {
+	vals, err := d.uints(tag)
+	if err != nil {
+		return 0, err
+	}
+	switch len(vals) {
+	case 0:
+		if _, ok := d.field(tag); ok {
+			return 0, errors.New("invalid IFD entry count")
+		}
+		return def, nil
+	case 1:
+		return vals[0], nil
+	}
+	return 0, errors.New("invalid IFD entry count")
+}
+
+// shortField returns a field with the provided SHORT values.
+func shortField(bo binary.ByteOrder, tag uint16, vals ...uint16) field {
+	f := field{Tag: tag, Type: typeShort, Count: uint32(len(vals)), Value: make([]byte, 2*len(vals))}
+	for i, v := range vals {
+		bo.PutUint16(f.Value[2*i:], v)
+	}
+	return f
+}
+
+// longField returns a field with the provided LONG values.
+func longField(bo binary.ByteOrder, tag uint16, vals ...uint32) field {
+	f := field{Tag: tag, Type: typeLong, Count: uint32(len(vals)), Value: make([]byte, 4*len(vals))}
+	for i, v := range vals {
+		bo.PutUint32(f.Value[4*i:], v)
+	}
+	return f
+}
+
+// long8Field returns a field with the provided LONG8 values. LONG8 fields are
+// only valid in BigTIFF files.
+func long8Field(bo binary.ByteOrder, tag uint16, vals ...uint64) field {
+	f := field{Tag: tag, Type: typeLong8, Count: uint32(len(vals)), Value: make([]byte, 8*len(vals))}
+	for i, v := range vals {
+		bo.PutUint64(f.Value[8*i:], v)
+	}
+	return f
+}
+
+// ifdLen returns the length of an IFD with the provided fields and the values
+// that do not fit in its entries, as encoded by putIFD at an even offset.
+func ifdLen(big bool, fields []field) int {
+	countLen, entryLen, valueLen := 2, ifdEntryLen, 4
+	if big {
+		countLen, entryLen, valueLen = 8, bigIFDEntryLen, 8
+	}
+	n := countLen + len(fields)*entryLen + valueLen
+	for _, f := range fields {
+		if len(f.Value) > valueLen {
+			n += n&1 + len(f.Value)
+		}
+	}
+	return n
+}
+
+// putIFD encodes an IFD with the provided fields, which must be sorted by tag,
+// to b at offset off. Values that do not fit in an entry are put directly after
+// the IFD. It returns the offset of the end of the IFD and its values, or an
+// error if they do not fit in b.
+//
+// If big is set, the IFD is encoded as a BigTIFF IFD.
+func putIFD(b []byte, bo binary.ByteOrder, big bool, off int, fields []field, next uint64) (int, error) {
+	countLen, entryLen, valueLen := 2, ifdEntryLen, 4
+	if big {
+		countLen, entryLen, valueLen = 8, bigIFDEntryLen, 8
+	}
+	end := off + countLen + len(fields)*entryLen + valueLen
+	if end > len(b) {
+		return 0, errors.New("IFD does not fit in header")
+	}
+	putUint := func(b []byte, v uint64) {
+		if big {
+			bo.PutUint64(b, v)
+		} else {
+			bo.PutUint32(b, uint32(v))
+		}
+	}
+	if big {
+		bo.PutUint64(b[off:], uint64(len(fields)))
+	} else {
+		bo.PutUint16(b[off:], uint16(len(fields)))
+	}
+	for i, f := range fields {
+		e := b[off+countLen+i*entryLen:]
+		bo.PutUint16(e[0:2], f.Tag)
+		bo.PutUint16(e[2:4], f.Type)
+		value := e[4+valueLen : 4+2*valueLen]
+		putUint(e[4:], uint64(f.Count))
+		if len(f.Value) <= valueLen {
+			copy(value, f.Value)
+			continue
+		}
+		// Values are aligned to word boundaries
+		end += end & 1
+		if end+len(f.Value) > len(b) {
+			return 0, errors.New("IFD does not fit in header")
+		}
+		putUint(value, uint64(end))
+		end += copy(b[end:], f.Value)
+	}
+	putUint(b[off+countLen+len(fields)*entryLen:], next)
+	return end, nil
+}
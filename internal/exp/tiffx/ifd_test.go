@@ -0,0 +1,51 @@
+package tiffx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadIFDUnknownType(t *testing.T) {
+	bo := binary.LittleEndian
+	fields := map[uint16]testField{
+		tagImageWidth:  {tagImageWidth, typeLong, []uint32{10}},
+		tagImageLength: {tagImageLength, typeLong, []uint32{2}},
+		305:            {305, typeShort, []uint32{1}}, // Software
+	}
+	b := make([]byte, headerLen)
+	putTestHeader(b, bo, false, headerLen)
+	b = putTestIFD(b, bo, false, headerLen, fields)
+
+	// withType returns b with the type of the entry with the provided tag
+	// replaced by typ
+	withType := func(tag, typ uint16) []byte {
+		res := append([]byte{}, b...)
+		for i := 0; i < len(fields); i++ {
+			e := res[headerLen+2+i*ifdEntryLen:]
+			if bo.Uint16(e) == tag {
+				bo.PutUint16(e[2:], typ)
+			}
+		}
+		return res
+	}
+	h := header{bo: bo, ifd: headerLen}
+
+	// Fields of unknown types are skipped
+	d, err := readIFD(bytes.NewReader(withType(305, 99)), h, headerLen)
+	require.NoError(t, err)
+	require.Len(t, d.fields, 2)
+	_, ok := d.field(305)
+	require.False(t, ok)
+	width, err := d.uint(tagImageWidth, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(10), width)
+
+	// Unless they describe the layout of the image
+	_, err = readIFD(bytes.NewReader(withType(tagImageWidth, 99)), h, headerLen)
+	require.Error(t, err)
+	_, err = readIFD(bytes.NewReader(withType(tagImageWidth, typeLong8)), h, headerLen)
+	require.Error(t, err)
+}
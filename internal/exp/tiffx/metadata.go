@@ -0,0 +1,159 @@
+package tiffx
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"math"
+)
+
+// Tags of metadata that are commonly carried over to cropped images, see
+// Options.Metadata.
+const (
+	TagXResolution         = 282
+	TagYResolution         = 283
+	TagResolutionUnit      = 296
+	TagModelPixelScale     = 33550 // GeoTIFF
+	TagModelTiepoint       = 33922 // GeoTIFF
+	TagModelTransformation = 34264 // GeoTIFF
+	TagICCProfile          = 34675
+	TagGeoKeyDirectory     = 34735 // GeoTIFF
+	TagGeoDoubleParams     = 34736 // GeoTIFF
+	TagGeoASCIIParams      = 34737 // GeoTIFF
+)
+
+// structuralTags holds tags that describe how an image is stored, or that
+// point to other structures in the file. They are never copied to cropped
+// images, which describe their own layout.
+var structuralTags = map[uint16]bool{
+	254:                          true, // NewSubfileType
+	255:                          true, // SubfileType
+	tagImageWidth:                true,
+	tagImageLength:               true,
+	tagBitsPerSample:             true,
+	tagCompression:               true,
+	tagPhotometricInterpretation: true,
+	266:                          true, // FillOrder
+	tagStripOffsets:              true,
+	tagSamplesPerPixel:           true,
+	tagRowsPerStrip:              true,
+	tagStripByteCounts:           true,
+	280:                          true, // MinSampleValue
+	281:                          true, // MaxSampleValue
+	tagPlanarConfiguration:       true,
+	288:                          true, // FreeOffsets
+	289:                          true, // FreeByteCounts
+	tagPredictor:                 true,
+	tagColorMap:                  true,
+	tagTileWidth:                 true,
+	tagTileLength:                true,
+	tagTileOffsets:               true,
+	tagTileByteCounts:            true,
+	tagSubIFDs:                   true,
+	tagExtraSamples:              true,
+	339:                          true, // SampleFormat
+	340:                          true, // SMinSampleValue
+	341:                          true, // SMaxSampleValue
+	347:                          true, // JPEGTables
+	530:                          true, // YCbCrSubSampling
+	531:                          true, // YCbCrPositioning
+	532:                          true, // ReferenceBlackWhite
+	34665:                        true, // Exif IFD
+	34853:                        true, // GPS IFD
+	40965:                        true, // Interoperability IFD
+}
+
+// metadata returns the fields of d that are selected by opts, converted to
+// little-endian, for an image that is cropped at offset. Fields of IFD type
+// are never copied. Georeferencing tags
+// are adjusted so that they map the pixels of the cropped image to the same
+// model coordinates as the pixels of d.
+func metadata(d ifd, opts *Options, offset image.Point) ([]field, error) {
+	selected := make(map[uint16]bool, len(opts.Metadata))
+	for _, tag := range opts.Metadata {
+		selected[tag] = true
+	}
+	var res []field
+	for _, f := range d.fields {
+		if structuralTags[f.Tag] || (!opts.AllMetadata && !selected[f.Tag]) {
+			continue
+		}
+		if f.Type == typeIFD || f.Type == typeIFD8 {
+			// Offsets of IFDs that are not known to be structural would point
+			// at arbitrary bytes of the cropped image
+			continue
+		}
+		f = f.littleEndian(d.bo)
+		var err error
+		switch f.Tag {
+		case TagModelTiepoint:
+			err = adjustTiepoints(f, offset)
+		case TagModelTransformation:
+			err = adjustTransformation(f, offset)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// littleEndian returns a copy of f with its values converted from bo to
+// little-endian.
+func (f field) littleEndian(bo binary.ByteOrder) field {
+	f.Value = append([]byte{}, f.Value...)
+	if bo == binary.LittleEndian {
+		return f
+	}
+	n := typeLen[f.Type]
+	if f.Type == typeRational || f.Type == typeSRational {
+		// Numerator and denominator are converted separately
+		n = 4
+	}
+	for i := 0; i+n <= len(f.Value); i += n {
+		v := f.Value[i : i+n]
+		for j := 0; j < n/2; j++ {
+			v[j], v[n-1-j] = v[n-1-j], v[j]
+		}
+	}
+	return f
+}
+
+// adjustTiepoints moves the raster points (I, J, K) of the little-endian
+// ModelTiepoint field f by -offset, so that they refer to the same pixels of
+// the cropped image.
+func adjustTiepoints(f field, offset image.Point) error {
+	if f.Type != typeDouble || f.Count%6 != 0 {
+		return errors.New("invalid ModelTiepoint")
+	}
+	for i := 0; i < int(f.Count); i += 6 {
+		addFloat64(f.Value[8*i:], -float64(offset.X))
+		addFloat64(f.Value[8*(i+1):], -float64(offset.Y))
+	}
+	return nil
+}
+
+// adjustTransformation moves the translation of the little-endian
+// ModelTransformation field f, a 4x4 matrix that maps raster coordinates to
+// model coordinates, so that the origin of the cropped image maps to the model
+// coordinates of offset.
+func adjustTransformation(f field, offset image.Point) error {
+	if f.Type != typeDouble || f.Count != 16 {
+		return errors.New("invalid ModelTransformation")
+	}
+	at := func(i int) float64 {
+		return math.Float64frombits(binary.LittleEndian.Uint64(f.Value[8*i:]))
+	}
+	for row := 0; row < 3; row++ {
+		d := at(4*row)*float64(offset.X) + at(4*row+1)*float64(offset.Y)
+		addFloat64(f.Value[8*(4*row+3):], d)
+	}
+	return nil
+}
+
+// addFloat64 adds d to the little-endian float64 in b.
+func addFloat64(b []byte, d float64) {
+	v := math.Float64frombits(binary.LittleEndian.Uint64(b))
+	binary.LittleEndian.PutUint64(b, math.Float64bits(v+d))
+}
@@ -0,0 +1,122 @@
+package tiffx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/tiff"
+)
+
+func TestCropAtMetadata(t *testing.T) {
+	icc := make([]uint32, 5000)
+	for i := range icc {
+		icc[i] = uint32(rand.Intn(256))
+	}
+	fields := []testField{
+		{254, typeLong, []uint32{0}}, // NewSubfileType
+		{TagXResolution, typeRational, []uint32{300, 1}},
+		{TagYResolution, typeRational, []uint32{150, 1}},
+		{TagResolutionUnit, typeShort, []uint32{2}},
+		{305, typeASCII, []uint32{'t', 'e', 's', 't', 0}}, // Software
+		{TagModelPixelScale, typeDouble, []uint32{10, 10, 0}},
+		{TagModelTiepoint, typeDouble, []uint32{0, 0, 0, 500000, 4000000, 0}},
+		{TagICCProfile, typeUndefined, icc},
+		{TagGeoKeyDirectory, typeShort, []uint32{1, 1, 0, 1, 1024, 0, 1, 1}},
+		{400, typeIFD, []uint32{8}}, // GlobalParametersIFD
+	}
+	for _, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		m := testPage(40, 30)
+		b, off := appendBaseline(make([]byte, headerLen), bo, m, fields...)
+		putTestHeader(b, bo, false, off)
+		region := image.Rect(5, 7, 25, 27)
+
+		for _, opts := range []*Options{
+			{AllMetadata: true},
+			{Metadata: []uint16{TagXResolution, TagModelTiepoint, TagICCProfile, tagImageWidth}},
+		} {
+			var dst bytes.Buffer
+			err := CropAtWithOptions(bytes.NewReader(b), &dst, region, opts)
+			require.NoError(t, err)
+
+			// The ICC profile does not fit before the default image offset
+			r := bytes.NewReader(dst.Bytes())
+			hdr, err := DecodeHeader(r)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3*ImageOffset), hdr.ImageOffset)
+			got, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.Equal(t, cropRGBA(m.rgba(bo), m.width, region), got)
+			_, err = tiff.Decode(bytes.NewReader(dst.Bytes()))
+			require.NoError(t, err)
+
+			dirs, _, err := readPages(bytes.NewReader(dst.Bytes()), 1)
+			require.NoError(t, err)
+			d := dirs[0]
+			le := binary.LittleEndian
+			xres, ok := d.field(TagXResolution)
+			require.True(t, ok)
+			require.Equal(t, []uint32{300, 1}, []uint32{le.Uint32(xres.Value), le.Uint32(xres.Value[4:])})
+			profile, ok := d.field(TagICCProfile)
+			require.True(t, ok)
+			require.Len(t, profile.Value, len(icc))
+			for i, v := range icc {
+				require.Equal(t, byte(v), profile.Value[i])
+			}
+			tiepoint, ok := d.field(TagModelTiepoint)
+			require.True(t, ok)
+			require.Equal(t, []float64{-5, -7, 0, 500000, 4000000, 0}, float64s(tiepoint.Value))
+			width, err := d.uint(tagImageWidth, 0)
+			require.NoError(t, err)
+			require.Equal(t, uint32(region.Dx()), width)
+
+			// Structural tags are never copied, and other tags only if all
+			// or they are selected
+			_, ok = d.field(254)
+			require.False(t, ok)
+			_, ok = d.field(400)
+			require.False(t, ok)
+			_, ok = d.field(305)
+			require.Equal(t, opts.AllMetadata, ok)
+			keys, ok := d.field(TagGeoKeyDirectory)
+			require.Equal(t, opts.AllMetadata, ok)
+			if ok {
+				require.Equal(t, uint16(1024), le.Uint16(keys.Value[8:]))
+			}
+		}
+	}
+}
+
+func TestAdjustTransformation(t *testing.T) {
+	// Pixels are 10 by -10 model units, with the origin at (100, 200)
+	m := []float64{
+		10, 0, 0, 100,
+		0, -10, 0, 200,
+		0, 0, 0, 0,
+		0, 0, 0, 1,
+	}
+	f := field{Tag: TagModelTransformation, Type: typeDouble, Count: 16, Value: make([]byte, 8*16)}
+	for i, v := range m {
+		binary.LittleEndian.PutUint64(f.Value[8*i:], math.Float64bits(v))
+	}
+	require.NoError(t, adjustTransformation(f, image.Pt(3, 4)))
+	m[3], m[7] = 130, 160
+	require.Equal(t, m, float64s(f.Value))
+
+	f.Count = 12
+	require.Error(t, adjustTransformation(f, image.Pt(3, 4)))
+}
+
+// float64s returns the little-endian float64 values in b.
+func float64s(b []byte) []float64 {
+	res := make([]float64, len(b)/8)
+	for i := range res {
+		res[i] = math.Float64frombits(binary.LittleEndian.Uint64(b[8*i:]))
+	}
+	return res
+}
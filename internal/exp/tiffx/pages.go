@@ -0,0 +1,159 @@
+package tiffx
+
+import (
+	"errors"
+	"image"
+	"io"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// Page is an image of a multi-page or pyramidal TIFF, see Pages.
+type Page struct {
+	Width, Height int
+
+	// Parent is the index of the page that holds this page in its SubIFDs, or
+	// -1 if the page is a top-level IFD.
+	Parent int
+}
+
+// maxPages is the maximum number of IFDs that are read from a file. It guards
+// against corrupt files with loops of IFDs.
+const maxPages = 1 << 12
+
+// Pages returns the pages of the TIFF in src. Top-level IFDs are returned in
+// file order, each followed by the IFDs listed in its SubIFDs, which commonly
+// hold the reduced resolution levels of a pyramid.
+//
+// The indices of the returned pages are used to select a page to crop, see
+// Options.
+func Pages(src io.ReaderAt) ([]Page, error) {
+	_, pages, err := readPages(src, -1)
+	return pages, err
+}
+
+// readPages reads the IFDs of the first n pages of the TIFF in r, or all pages
+// if n is negative, in the order described by Pages.
+func readPages(r io.ReaderAt, n int) ([]ifd, []Page, error) {
+	var b [bigHeaderLen]byte
+	if err := ioutilx.ReadFullAt(r, b[:headerLen], 0); err != nil {
+		return nil, nil, err
+	}
+	if b[2]+b[3] == 43 {
+		// The BigTIFF header holds a 64-bit IFD offset
+		if err := ioutilx.ReadFullAt(r, b[headerLen:], headerLen); err != nil {
+			return nil, nil, err
+		}
+	}
+	h, err := parseHeader(b[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dirs []ifd
+	var pages []Page
+	seen := make(map[uint64]bool)
+	add := func(off uint64, parent int) (ifd, error) {
+		if seen[off] || len(seen) >= maxPages || off > 1<<63-1 {
+			return ifd{}, errors.New("invalid IFD offset")
+		}
+		seen[off] = true
+		d, err := readIFD(r, h, int64(off))
+		if err != nil {
+			return d, err
+		}
+		width, err := d.uint(tagImageWidth, 0)
+		if err != nil {
+			return d, err
+		}
+		height, err := d.uint(tagImageLength, 0)
+		if err != nil {
+			return d, err
+		}
+		dirs = append(dirs, d)
+		pages = append(pages, Page{Width: int(width), Height: int(height), Parent: parent})
+		return d, nil
+	}
+	full := func() bool {
+		return n >= 0 && len(dirs) >= n
+	}
+	for off := uint64(h.ifd); off != 0 && !full(); {
+		d, err := add(off, -1)
+		if err != nil {
+			return nil, nil, err
+		}
+		parent := len(dirs) - 1
+		subs, err := d.uint64s(tagSubIFDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, sub := range subs {
+			// SubIFDs may also be chained, in which case the chain may list
+			// the same IFDs as the SubIFDs field
+			for off := sub; off != 0 && !seen[off] && !full(); {
+				sd, err := add(off, parent)
+				if err != nil {
+					return nil, nil, err
+				}
+				off = sd.next
+			}
+		}
+		off = d.next
+	}
+	if len(dirs) == 0 {
+		return nil, nil, errors.New("invalid IFD offset")
+	}
+	return dirs, pages, nil
+}
+
+// pyramidLevel returns the index of the smallest level of the page at index
+// ref in which region spans at least size pixels, or ref if there is none. See
+// Options.Size for which pages are levels. Levels that are not supported by
+// CropAt are skipped.
+func pyramidLevel(dirs []ifd, pages []Page, ref int, region image.Rectangle, size image.Point) int {
+	best := ref
+	p := pages[ref]
+	for i, level := range pages {
+		if level.Width*level.Height >= pages[best].Width*pages[best].Height || !isLevel(p, level) {
+			continue
+		}
+		r := scaleRegion(region, p, level)
+		if r.Dx() < size.X || r.Dy() < size.Y {
+			continue
+		}
+		if _, err := newLayout(dirs[i]); err == nil {
+			best = i
+		}
+	}
+	return best
+}
+
+// isLevel returns whether the page level has the same aspect ratio as p up to
+// rounding of its dimensions, and is no larger than p.
+func isLevel(p, level Page) bool {
+	if level.Width <= 0 || level.Height <= 0 || level.Width > p.Width || level.Height > p.Height {
+		return false
+	}
+	// When the level dimensions are those of p divided by some scale, rounded
+	// up or down, the cross products differ by less than p's width plus its
+	// height
+	d := int64(p.Width)*int64(level.Height) - int64(p.Height)*int64(level.Width)
+	if d < 0 {
+		d = -d
+	}
+	return d < int64(p.Width)+int64(p.Height)
+}
+
+// scaleRegion scales region from the coordinates of page from to those of page
+// to. The scaled region covers all pixels that are covered by region.
+func scaleRegion(region image.Rectangle, from, to Page) image.Rectangle {
+	scale := func(v, num, den int) (lo, hi int) {
+		x := int64(v) * int64(num)
+		return int(x / int64(den)), int((x + int64(den) - 1) / int64(den))
+	}
+	x0, _ := scale(region.Min.X, to.Width, from.Width)
+	_, x1 := scale(region.Max.X, to.Width, from.Width)
+	y0, _ := scale(region.Min.Y, to.Height, from.Height)
+	_, y1 := scale(region.Max.Y, to.Height, from.Height)
+	return image.Rect(x0, y0, x1, y1)
+}
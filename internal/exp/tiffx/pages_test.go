@@ -0,0 +1,126 @@
+package tiffx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPages(t *testing.T) {
+	pages := []baselineImage{testPage(64, 48), testPage(10, 10)}
+	subs := map[int][]baselineImage{0: {testPage(32, 24), testPage(16, 12)}}
+	got, err := Pages(bytes.NewReader(encodePages(binary.LittleEndian, pages, subs)))
+	require.NoError(t, err)
+	require.Equal(t, []Page{
+		{Width: 64, Height: 48, Parent: -1},
+		{Width: 32, Height: 24, Parent: 0},
+		{Width: 16, Height: 12, Parent: 0},
+		{Width: 10, Height: 10, Parent: -1},
+	}, got)
+
+	// Loops of IFDs are invalid
+	b := encodePages(binary.LittleEndian, pages, nil)
+	off := int(binary.LittleEndian.Uint32(b[4:8]))
+	putTestNext(b, binary.LittleEndian, off, off)
+	_, err = Pages(bytes.NewReader(b))
+	require.Error(t, err)
+}
+
+func TestCropAtWithOptions(t *testing.T) {
+	// A pyramid stored in SubIFDs, followed by a label, and a pyramid stored
+	// in top-level IFDs
+	bo := binary.BigEndian
+	pages := []baselineImage{testPage(64, 48), testPage(10, 10)}
+	subs := map[int][]baselineImage{0: {testPage(32, 24), testPage(16, 12)}}
+	all := []baselineImage{pages[0], subs[0][0], subs[0][1], pages[1]}
+	src := encodePages(bo, pages, subs)
+	topLevel := []baselineImage{testPage(64, 48), testPage(31, 23)}
+	topLevelSrc := encodePages(bo, topLevel, nil)
+
+	for _, tc := range []struct {
+		name   string
+		src    []byte
+		region image.Rectangle
+		opts   *Options
+		want   []byte
+	}{
+		{"default", src, image.Rect(3, 4, 20, 30), nil, cropRGBA(all[0].rgba(bo), 64, image.Rect(3, 4, 20, 30))},
+		{"sub page", src, image.Rect(3, 4, 20, 30), &Options{Page: 1}, cropRGBA(all[1].rgba(bo), 32, image.Rect(3, 4, 20, 24))},
+		{"label", src, image.Rect(0, 0, 100, 100), &Options{Page: 3}, all[3].rgba(bo)},
+		{"level", src, image.Rect(8, 8, 40, 40), &Options{Size: image.Pt(10, 10)}, cropRGBA(all[1].rgba(bo), 32, image.Rect(4, 4, 20, 20))},
+		{"smallest level", src, image.Rect(8, 8, 40, 40), &Options{Size: image.Pt(4, 4)}, cropRGBA(all[2].rgba(bo), 16, image.Rect(2, 2, 10, 10))},
+		{"no level", src, image.Rect(8, 8, 40, 40), &Options{Size: image.Pt(40, 40)}, cropRGBA(all[0].rgba(bo), 64, image.Rect(8, 8, 40, 40))},
+		{"level of sub page", src, image.Rect(4, 4, 20, 20), &Options{Page: 1, Size: image.Pt(8, 8)}, cropRGBA(all[2].rgba(bo), 16, image.Rect(2, 2, 10, 10))},
+		{"top-level", topLevelSrc, image.Rect(8, 8, 40, 40), &Options{Size: image.Pt(10, 10)}, cropRGBA(topLevel[1].rgba(bo), 31, image.Rect(3, 3, 20, 20))},
+	} {
+		var dst bytes.Buffer
+		err := CropAtWithOptions(bytes.NewReader(tc.src), &dst, tc.region, tc.opts)
+		require.NoError(t, err, tc.name)
+		r := bytes.NewReader(dst.Bytes())
+		_, err = DecodeHeader(r)
+		require.NoError(t, err, tc.name)
+		got, err := io.ReadAll(r)
+		require.NoError(t, err, tc.name)
+		require.Equal(t, tc.want, got, tc.name)
+	}
+
+	err := CropAtWithOptions(bytes.NewReader(src), &bytes.Buffer{}, image.Rect(0, 0, 10, 10), &Options{Page: 4})
+	require.Error(t, err)
+	err = CropAtWithOptions(bytes.NewReader(src), &bytes.Buffer{}, image.Rect(0, 0, 10, 10), &Options{Page: -1})
+	require.Error(t, err)
+}
+
+// testPage returns an RGB image with random pixels.
+func testPage(w, h int) baselineImage {
+	m := baselineImage{
+		width:        w,
+		height:       h,
+		photometric:  photometricRGB,
+		bits:         8,
+		samples:      3,
+		rowsPerStrip: 1 + rand.Intn(h),
+		compression:  compressionNone,
+	}
+	m.randPix()
+	return m
+}
+
+// encodePages encodes a classic TIFF with the provided top-level pages, where
+// the pages in subs[i] are stored in the SubIFDs of page i.
+func encodePages(bo binary.ByteOrder, pages []baselineImage, subs map[int][]baselineImage) []byte {
+	b := make([]byte, headerLen)
+	prev := -1
+	for i, m := range pages {
+		var offsets []uint32
+		for _, sub := range subs[i] {
+			var off int
+			b, off = appendBaseline(b, bo, sub)
+			offsets = append(offsets, uint32(off))
+		}
+		var fields []testField
+		if offsets != nil {
+			fields = append(fields, testField{tagSubIFDs, typeIFD, offsets})
+		}
+		var off int
+		b, off = appendBaseline(b, bo, m, fields...)
+		if prev < 0 {
+			putTestHeader(b, bo, false, off)
+		} else {
+			putTestNext(b, bo, prev, off)
+		}
+		prev = off
+	}
+	return b
+}
+
+// putTestNext sets the offset of the IFD that follows the classic IFD at off
+// of b.
+func putTestNext(b []byte, bo binary.ByteOrder, off, next int) {
+	n := int(bo.Uint16(b[off:]))
+	bo.PutUint32(b[off+2+n*ifdEntryLen:], uint32(next))
+}
@@ -3,42 +3,230 @@ package tiffx
 import (
 	"encoding/binary"
 	"errors"
+	"image"
+	"image/color"
 	"io"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
 )
 
+// ImageOffset is the offset of the image data in a TIFF of the strict profile.
+// The header, IFD and any values that do not fit in the IFD entries are stored
+// before it. Files with metadata that does not fit before ImageOffset store the
+// image at the next multiple of ImageOffset instead.
+const ImageOffset = 2048
+
+// maxImageOffset is the maximum offset of the image data in a TIFF of the
+// strict profile.
+const maxImageOffset = 64 << 20
+
+// DecodeResult holds the significant contents of the header of a TIFF in the
+// strict profile.
 type DecodeResult struct {
 	ByteOrder binary.ByteOrder
-}
+	Config    image.Config
 
-func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
-	const (
-		leHeader = "II\x2A\x00" // Header for little-endian files.
-		beHeader = "MM\x00\x2A" // Header for big-endian files.
+	// BitsPerPixel is the size of a pixel. Pixels are stored as 8-bit red,
+	// green, blue and alpha samples in that order.
+	BitsPerPixel int
+
+	// Premultiplied is set when the color samples are premultiplied by alpha
+	// (associated alpha), in which case the color model is color.RGBAModel.
+	// Otherwise, the color model is color.NRGBAModel.
+	Premultiplied bool
 
-		ifdLen = 12 // Length of an IFD entry in bytes.
-	)
+	// ImageOffset is the offset of the first row of the image, and
+	// ImageByteCount the size of the image data. Rows are stored top-down
+	// without padding.
+	ImageOffset    uint64
+	ImageByteCount uint64
+
+	// BigTIFF is set when the file is a BigTIFF, which is used for images
+	// larger than 4GiB.
+	BigTIFF bool
+}
 
+// DecodeHeader decodes the header of a TIFF in the strict profile described in
+// the README from the input stream. On success, exactly res.ImageOffset bytes
+// have been read from r, so that the next byte read is the first byte of the
+// image.
+//
+// Both classic TIFF and BigTIFF files are supported. The header must be
+// followed directly by a single IFD, which along with any values that do not
+// fit in its entries is stored before the image. The image must be an
+// uncompressed, chunky RGBA image with 8 bits per sample that is stored in a
+// single strip at ImageOffset, or a later multiple of ImageOffset.
+func DecodeHeader(r io.Reader) (res DecodeResult, err error) {
 	var empty DecodeResult
-	var b [1024]byte
+	hr := &headerReader{r: r}
 
 	// Read header
-	if _, err := io.ReadFull(r, b[:8]); err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+	if err := hr.fill(ImageOffset); err != nil {
+		return empty, err
+	}
+
+	h, err := parseHeader(hr.b)
+	if err != nil {
+		return empty, err
+	}
+	res.ByteOrder, res.BigTIFF = h.bo, h.big
+	if (!h.big && h.ifd != headerLen) || (h.big && h.ifd != bigHeaderLen) {
+		return empty, errors.New("unsupported: IFD must follow the header")
+	}
+	d, err := readIFD(hr, h, h.ifd)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errHeaderRegion
 		}
 		return empty, err
 	}
+	if d.next != 0 {
+		return empty, errors.New("unsupported: more than one image")
+	}
+	if err := validateIFD(d); err != nil {
+		return empty, err
+	}
 
-	switch string(b[0:4]) {
-	case leHeader:
-		res.ByteOrder = binary.LittleEndian
-	case beHeader:
-		res.ByteOrder = binary.BigEndian
-	default:
-		return empty, errors.New("unsupported binary format")
+	width, err := d.uint(tagImageWidth, 0)
+	if err != nil {
+		return empty, err
+	}
+	height, err := d.uint(tagImageLength, 0)
+	if err != nil {
+		return empty, err
+	}
+	if width == 0 || height == 0 || width > 1<<30 || height > 1<<30 {
+		return empty, errors.New("unsupported image dimensions")
+	}
+	extra, err := d.uints(tagExtraSamples)
+	if err != nil {
+		return empty, err
 	}
+	res.Config = image.Config{ColorModel: color.NRGBAModel, Width: int(width), Height: int(height)}
+	if extra[0] == extraSamplesAssociated {
+		res.Premultiplied = true
+		res.Config.ColorModel = color.RGBAModel
+	}
+	res.BitsPerPixel = 32
 
-	ifdOffset := int64(res.ByteOrder.Uint32(b[4:8]))
-	_ = ifdOffset
-	return res, errors.New("not totally done, yet")
+	// The image is stored in a single strip at ImageOffset
+	offsets, err := d.uint64s(tagStripOffsets)
+	if err != nil {
+		return empty, err
+	}
+	counts, err := d.uint64s(tagStripByteCounts)
+	if err != nil {
+		return empty, err
+	}
+	if len(offsets) != 1 || len(counts) != 1 {
+		return empty, errors.New("unsupported: image must be stored in a single strip")
+	}
+	off := offsets[0]
+	if off < ImageOffset || off%ImageOffset != 0 || off > maxImageOffset {
+		return empty, errors.New("unsupported: image must start at offset 2048 or a multiple of it")
+	}
+	if uint64(len(hr.b)) > off {
+		return empty, errHeaderRegion
+	}
+	rowsPerStrip, err := d.uint(tagRowsPerStrip, 1<<32-1)
+	if err != nil {
+		return empty, err
+	}
+	size := uint64(width) * uint64(height) * 4
+	if rowsPerStrip < height || counts[0] < size {
+		return empty, errors.New("unsupported: image must be stored in a single strip")
+	}
+	// Skip to the image
+	if _, err := io.CopyN(io.Discard, r, int64(off)-int64(len(hr.b))); err != nil {
+		return empty, ioutilx.NoEOF(err)
+	}
+	res.ImageOffset = off
+	res.ImageByteCount = size
+	return res, nil
+}
+
+var errHeaderRegion = errors.New("unsupported: IFD must fit within the header region")
+
+// headerReader reads the header region at the start of a stream. Bytes are
+// read from the stream and kept in b as far as they are accessed.
+type headerReader struct {
+	r io.Reader
+	b []byte
+}
+
+// fill reads from the stream until b holds at least n bytes.
+func (h *headerReader) fill(n int) error {
+	if n <= len(h.b) {
+		return nil
+	}
+	if n > maxImageOffset {
+		return errHeaderRegion
+	}
+	m := len(h.b)
+	h.b = append(h.b, make([]byte, n-m)...)
+	if _, err := io.ReadFull(h.r, h.b[m:]); err != nil {
+		h.b = h.b[:m]
+		return ioutilx.NoEOF(err)
+	}
+	return nil
+}
+
+func (h *headerReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > maxImageOffset {
+		return 0, errHeaderRegion
+	}
+	if err := h.fill(int(off) + len(p)); err != nil {
+		return 0, err
+	}
+	return copy(p, h.b[off:]), nil
+}
+
+// validateIFD checks that the IFD describes an uncompressed, chunky RGBA image
+// with 8 bits per sample.
+func validateIFD(d ifd) error {
+	compression, err := d.uint(tagCompression, compressionNone)
+	if err != nil {
+		return err
+	}
+	if compression != compressionNone {
+		return errors.New("unsupported compression")
+	}
+	photometric, err := d.uint(tagPhotometricInterpretation, 0)
+	if err != nil {
+		return err
+	}
+	if photometric != photometricRGB {
+		return errors.New("unsupported photometric interpretation")
+	}
+	planar, err := d.uint(tagPlanarConfiguration, planarChunky)
+	if err != nil {
+		return err
+	}
+	if planar != planarChunky {
+		return errors.New("unsupported planar configuration")
+	}
+	samples, err := d.uint(tagSamplesPerPixel, 1)
+	if err != nil {
+		return err
+	}
+	bits, err := d.uints(tagBitsPerSample)
+	if err != nil {
+		return err
+	}
+	if samples != 4 || len(bits) != 4 {
+		return errors.New("unsupported: image must be RGBA")
+	}
+	for _, n := range bits {
+		if n != 8 {
+			return errors.New("unsupported bits per sample")
+		}
+	}
+	extra, err := d.uints(tagExtraSamples)
+	if err != nil {
+		return err
+	}
+	if len(extra) != 1 || extra[0] > extraSamplesUnassociated {
+		return errors.New("unsupported: image must be RGBA")
+	}
+	return nil
 }
@@ -1,7 +1,15 @@
 package tiffx
 
 import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -32,3 +40,221 @@ func TestTIFF(t *testing.T) {
 	img, _ := tiff.Decode(f)
 	_ = img
 }
+
+func TestDecodeHeader(t *testing.T) {
+	for i, bo := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian, binary.LittleEndian, binary.BigEndian} {
+		big := i >= 2
+		img := randNRGBA(13, 7)
+		var fields []testField
+		if big {
+			fields = []testField{{tagStripByteCounts, typeLong8, []uint32{uint32(len(img.Pix))}}}
+		}
+		b := encodeStrict(bo, big, img.Rect.Dx(), img.Rect.Dy(), fields, img.Pix)
+		r := bytes.NewReader(b)
+		hdr, err := DecodeHeader(r)
+		require.NoError(t, err)
+		require.Equal(t, bo, hdr.ByteOrder)
+		require.Equal(t, big, hdr.BigTIFF)
+		require.Equal(t, 13, hdr.Config.Width)
+		require.Equal(t, 7, hdr.Config.Height)
+		require.Equal(t, color.NRGBAModel, hdr.Config.ColorModel)
+		require.Equal(t, 32, hdr.BitsPerPixel)
+		require.Equal(t, uint64(ImageOffset), hdr.ImageOffset)
+		require.Equal(t, uint64(len(img.Pix)), hdr.ImageByteCount)
+
+		// The reader is positioned at the start of the image
+		rest, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, img.Pix, rest)
+	}
+
+	// Image at a later multiple of ImageOffset
+	img := randNRGBA(13, 7)
+	fields := []testField{
+		{tagStripOffsets, typeLong, []uint32{2 * ImageOffset}},
+		{tagStripByteCounts, typeLong, []uint32{uint32(len(img.Pix))}},
+	}
+	b := encodeStrict(binary.LittleEndian, false, 13, 7, fields, append(make([]byte, ImageOffset), img.Pix...))
+	r := bytes.NewReader(b)
+	hdr, err := DecodeHeader(r)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2*ImageOffset), hdr.ImageOffset)
+	rest, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, img.Pix, rest)
+}
+
+func TestDecodeHeaderInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		fields []testField
+	}{
+		{"lzw", []testField{{tagCompression, typeShort, []uint32{5}}}},
+		{"rgb", []testField{{tagSamplesPerPixel, typeShort, []uint32{3}}, {tagBitsPerSample, typeShort, []uint32{8, 8, 8}}}},
+		{"16-bit", []testField{{tagBitsPerSample, typeShort, []uint32{16, 16, 16, 16}}}},
+		{"gray", []testField{{tagPhotometricInterpretation, typeShort, []uint32{1}}}},
+		{"planar", []testField{{tagPlanarConfiguration, typeShort, []uint32{2}}}},
+		{"offset", []testField{{tagStripOffsets, typeLong, []uint32{3000}}}},
+		{"strips", []testField{{tagStripOffsets, typeLong, []uint32{2048, 2048 + 40}}, {tagStripByteCounts, typeLong, []uint32{40, 40}}}},
+		{"rows per strip", []testField{{tagRowsPerStrip, typeLong, []uint32{1}}}},
+		{"overflow", []testField{{tagBitsPerSample, typeShort, make([]uint32, 2000)}}},
+	} {
+		b := encodeStrict(binary.LittleEndian, false, 10, 2, tc.fields, make([]byte, 80))
+		_, err := DecodeHeader(bytes.NewReader(b))
+		require.Error(t, err, tc.name)
+	}
+
+	// IFD placed after the image
+	b := encodeStrict(binary.LittleEndian, false, 10, 2, nil, make([]byte, 80))
+	binary.LittleEndian.PutUint32(b[4:8], 16)
+	_, err := DecodeHeader(bytes.NewReader(b))
+	require.Error(t, err)
+
+	// LONG8 fields in a classic TIFF
+	b = encodeStrict(binary.LittleEndian, false, 10, 2, []testField{{tagStripByteCounts, typeLong8, []uint32{80}}}, make([]byte, 80))
+	_, err = DecodeHeader(bytes.NewReader(b))
+	require.Error(t, err)
+
+	// BigTIFF with offsets of another size than 8 bytes
+	b = encodeStrict(binary.LittleEndian, true, 10, 2, nil, make([]byte, 80))
+	binary.LittleEndian.PutUint16(b[4:6], 4)
+	_, err = DecodeHeader(bytes.NewReader(b))
+	require.Error(t, err)
+}
+
+// testField is an IFD entry with integer values.
+type testField struct {
+	tag    uint16
+	typ    uint16
+	values []uint32
+}
+
+// encodeStrict encodes an RGBA TIFF in the strict profile, where fields
+// replace or add to the default fields. Values that do not fit in their
+// entries are written after the IFD, which may overflow into the image. If big
+// is set, the TIFF is a BigTIFF.
+func encodeStrict(bo binary.ByteOrder, big bool, width, height int, fields []testField, pix []byte) []byte {
+	all := map[uint16]testField{}
+	for _, f := range []testField{
+		{tagImageWidth, typeLong, []uint32{uint32(width)}},
+		{tagImageLength, typeLong, []uint32{uint32(height)}},
+		{tagBitsPerSample, typeShort, []uint32{8, 8, 8, 8}},
+		{tagCompression, typeShort, []uint32{compressionNone}},
+		{tagPhotometricInterpretation, typeShort, []uint32{photometricRGB}},
+		{tagStripOffsets, typeLong, []uint32{ImageOffset}},
+		{tagSamplesPerPixel, typeShort, []uint32{4}},
+		{tagRowsPerStrip, typeLong, []uint32{uint32(height)}},
+		{tagStripByteCounts, typeLong, []uint32{uint32(len(pix))}},
+		{tagExtraSamples, typeShort, []uint32{extraSamplesUnassociated}},
+	} {
+		all[f.tag] = f
+	}
+	for _, f := range fields {
+		all[f.tag] = f
+	}
+	off := headerLen
+	if big {
+		off = bigHeaderLen
+	}
+	b := make([]byte, ImageOffset)
+	putTestHeader(b, bo, big, off)
+	b = putTestIFD(b, bo, big, off, all)
+	return append(b, pix...)
+}
+
+// putTestHeader puts a file header pointing at the IFD at off into b. If big
+// is set, the header is a BigTIFF header.
+func putTestHeader(b []byte, bo binary.ByteOrder, big bool, off int) {
+	copy(b, "MM")
+	if bo == binary.LittleEndian {
+		copy(b, "II")
+	}
+	if big {
+		bo.PutUint16(b[2:4], 43)
+		bo.PutUint16(b[4:6], 8)
+		bo.PutUint64(b[8:16], uint64(off))
+		return
+	}
+	bo.PutUint16(b[2:4], 42)
+	bo.PutUint32(b[4:8], uint32(off))
+}
+
+// putTestIFD puts an IFD with the provided fields at offset off of b, followed
+// by any values that do not fit in their entries. b is extended as needed. If
+// big is set, the IFD is a BigTIFF IFD.
+func putTestIFD(b []byte, bo binary.ByteOrder, big bool, off int, fields map[uint16]testField) []byte {
+	tags := make([]int, 0, len(fields))
+	for tag := range fields {
+		tags = append(tags, int(tag))
+	}
+	sort.Ints(tags)
+
+	countLen, entryLen, valueLen := 2, ifdEntryLen, 4
+	if big {
+		countLen, entryLen, valueLen = 8, bigIFDEntryLen, 8
+	}
+	overflow := off + countLen + len(tags)*entryLen + valueLen
+	if overflow > len(b) {
+		b = append(b, make([]byte, overflow-len(b))...)
+	}
+	if big {
+		bo.PutUint64(b[off:], uint64(len(tags)))
+	} else {
+		bo.PutUint16(b[off:], uint16(len(tags)))
+	}
+	for i, tag := range tags {
+		f := fields[uint16(tag)]
+		e := b[off+countLen+i*entryLen:]
+		bo.PutUint16(e[0:2], f.tag)
+		bo.PutUint16(e[2:4], f.typ)
+		value := e[4+valueLen : 4+2*valueLen]
+		// Rationals are given as numerators and denominators, and doubles as
+		// integers
+		size := typeLen[f.typ]
+		if f.typ == typeRational {
+			size = 4
+		}
+		v := make([]byte, len(f.values)*size)
+		count := len(v) / typeLen[f.typ]
+		if big {
+			bo.PutUint64(e[4:12], uint64(count))
+		} else {
+			bo.PutUint32(e[4:8], uint32(count))
+		}
+		for j, x := range f.values {
+			switch {
+			case size == 1:
+				v[j] = byte(x)
+			case size == 2:
+				bo.PutUint16(v[2*j:], uint16(x))
+			case f.typ == typeDouble:
+				bo.PutUint64(v[8*j:], math.Float64bits(float64(x)))
+			case size == 8:
+				bo.PutUint64(v[8*j:], uint64(x))
+			default:
+				bo.PutUint32(v[4*j:], x)
+			}
+		}
+		if len(v) <= valueLen {
+			copy(value, v)
+			continue
+		}
+		if big {
+			bo.PutUint64(value, uint64(overflow))
+		} else {
+			bo.PutUint32(value, uint32(overflow))
+		}
+		if overflow+len(v) > len(b) {
+			b = append(b, make([]byte, overflow+len(v)-len(b))...)
+		}
+		overflow += copy(b[overflow:], v)
+	}
+	return b
+}
+
+// randNRGBA returns an image with random pixels.
+func randNRGBA(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	rand.Read(img.Pix)
+	return img
+}
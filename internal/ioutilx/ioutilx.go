@@ -0,0 +1,35 @@
+// Package ioutilx holds I/O helpers that are shared by the croppers of this
+// module.
+package ioutilx
+
+import "io"
+
+// Skipper returns a function that skips off bytes of src. It seeks if
+// possible, otherwise it copies to discard.
+func Skipper(src io.Reader) func(off int) (n int64, err error) {
+	if s, ok := src.(io.Seeker); ok {
+		return func(off int) (n int64, err error) {
+			return s.Seek(int64(off), io.SeekCurrent)
+		}
+	}
+	return func(off int) (n int64, err error) {
+		return io.CopyN(io.Discard, src, int64(off))
+	}
+}
+
+// ReadFullAt reads exactly len(b) bytes from r at off.
+func ReadFullAt(r io.ReaderAt, b []byte, off int64) error {
+	n, err := r.ReadAt(b, off)
+	if n == len(b) {
+		return nil
+	}
+	return NoEOF(err)
+}
+
+// NoEOF returns io.ErrUnexpectedEOF in place of io.EOF.
+func NoEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
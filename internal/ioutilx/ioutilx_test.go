@@ -0,0 +1,31 @@
+package ioutilx
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipper(t *testing.T) {
+	for _, r := range []io.Reader{
+		bytes.NewReader([]byte("0123456789")),
+		io.MultiReader(bytes.NewReader([]byte("0123456789"))), // Not seekable
+	} {
+		_, err := Skipper(r)(4)
+		require.NoError(t, err)
+		b, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "456789", string(b))
+	}
+}
+
+func TestReadFullAt(t *testing.T) {
+	r := bytes.NewReader([]byte("0123456789"))
+	b := make([]byte, 4)
+	require.NoError(t, ReadFullAt(r, b, 6))
+	require.Equal(t, "6789", string(b))
+	require.Equal(t, io.ErrUnexpectedEOF, ReadFullAt(r, b, 8))
+	require.Equal(t, io.ErrUnexpectedEOF, NoEOF(io.EOF))
+}
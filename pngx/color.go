@@ -0,0 +1,80 @@
+package pngx
+
+import (
+	"encoding/binary"
+	"image/color"
+)
+
+// AppendNRGBA appends pixels [from, to) of the unfiltered row pix, as returned
+// by Decoder.Next, to dst as non-premultiplied 8-bit RGBA. Samples of less
+// than 8 bits are scaled up, and 16-bit samples are truncated to their high
+// byte. Pixels that match the transparent color of the header get an alpha of
+// zero.
+func (h *Header) AppendNRGBA(dst, pix []byte, from, to int) []byte {
+	n := h.ColorType.samples()
+	mask := byte(1)<<uint(h.BitDepth) - 1
+	var s [4]uint16
+	for x := from; x < to; x++ {
+		switch h.BitDepth {
+		case 16:
+			for i := 0; i < n; i++ {
+				s[i] = binary.BigEndian.Uint16(pix[2*(n*x+i):])
+			}
+		case 8:
+			for i := 0; i < n; i++ {
+				s[i] = uint16(pix[n*x+i])
+			}
+		default:
+			// Gray or Paletted with 1, 2 or 4 bits per pixel, leftmost pixel
+			// in the high bits
+			shift := 8 - uint(h.BitDepth) - uint(x*h.BitDepth%8)
+			s[0] = uint16(pix[x*h.BitDepth/8] >> shift & mask)
+		}
+		dst = h.appendPixel(dst, &s)
+	}
+	return dst
+}
+
+// appendPixel appends the NRGBA color of a pixel with the samples s, as
+// stored, to dst.
+func (h *Header) appendPixel(dst []byte, s *[4]uint16) []byte {
+	switch h.ColorType {
+	case Gray:
+		y := h.scale(s[0])
+		a := uint8(0xff)
+		if len(h.Transparent) == 1 && s[0] == h.Transparent[0] {
+			a = 0
+		}
+		return append(dst, y, y, y, a)
+	case GrayAlpha:
+		y := h.scale(s[0])
+		return append(dst, y, y, y, h.scale(s[1]))
+	case RGB:
+		a := uint8(0xff)
+		if len(h.Transparent) == 3 && s[0] == h.Transparent[0] && s[1] == h.Transparent[1] && s[2] == h.Transparent[2] {
+			a = 0
+		}
+		return append(dst, h.scale(s[0]), h.scale(s[1]), h.scale(s[2]), a)
+	case RGBA:
+		return append(dst, h.scale(s[0]), h.scale(s[1]), h.scale(s[2]), h.scale(s[3]))
+	case Paletted:
+		if int(s[0]) >= len(h.Palette) {
+			// Out of range indices are opaque black, like in image/png
+			return append(dst, 0, 0, 0, 0xff)
+		}
+		c := color.NRGBAModel.Convert(h.Palette[s[0]]).(color.NRGBA)
+		return append(dst, c.R, c.G, c.B, c.A)
+	}
+	return dst
+}
+
+// scale scales a sample of the bit depth of h to 8 bits.
+func (h *Header) scale(v uint16) uint8 {
+	switch h.BitDepth {
+	case 16:
+		return uint8(v >> 8)
+	case 8:
+		return uint8(v)
+	}
+	return uint8(v * 0xff / (1<<uint(h.BitDepth) - 1))
+}
@@ -0,0 +1,244 @@
+package pngx
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/sebnyberg/imgcrop/internal/exp/tiffx"
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// Format is the image format of a cropped image.
+type Format int
+
+const (
+	PNG  Format = iota // PNG with the color type and bit depth of the input
+	BMP                // Top-down BMP, with 32 bits per pixel if the input has alpha and 24 otherwise
+	TIFF               // TIFF in the strict profile of tiffx
+)
+
+// Options are the cropping options. A nil *Options means the defaults.
+type Options struct {
+	// Format is the format of the cropped image, PNG by default. BMP and TIFF
+	// images hold 8-bit samples, see Header.AppendNRGBA.
+	Format Format
+}
+
+// Crop crops the provided region of the PNG found in the input stream to a
+// PNG in the output stream.
+//
+// Rows are decoded one at a time and only the pixels within the region are
+// kept, so memory use depends on the width of the image rather than its size.
+// Decoding stops after the last row of the region, so cropping from the top of
+// a large image only reads a fraction of it.
+//
+// Interlaced images hold the rows of the region in every pass, so the pixels
+// of the region are gathered in memory before they are written, and all passes
+// but the last are decoded in full.
+func Crop(src io.Reader, dst io.Writer, region image.Rectangle) error {
+	return CropWithOptions(src, dst, region, nil)
+}
+
+// CropWithOptions is like Crop, but with options.
+func CropWithOptions(src io.Reader, dst io.Writer, region image.Rectangle, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	d, err := NewDecoder(src)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	hdr := d.Header()
+
+	region = image.Rect(0, 0, hdr.Width, hdr.Height).Intersect(region)
+	if region.Empty() {
+		return errors.New("crop area empty or out of bounds")
+	}
+	out := hdr
+	out.Width, out.Height = region.Dx(), region.Dy()
+	out.Interlaced = false
+	w, err := newRowWriter(dst, out, opts.Format)
+	if err != nil {
+		return err
+	}
+
+	if hdr.Interlaced {
+		err = cropInterlaced(d, w, region)
+	} else {
+		err = cropRows(d, w, region)
+	}
+	if err != nil {
+		return err
+	}
+	return w.close()
+}
+
+// cropRows crops the region of an image that is not interlaced, writing each
+// row as soon as it has been decoded.
+func cropRows(d *Decoder, w rowWriter, region image.Rectangle) error {
+	hdr := d.Header()
+	bpp := hdr.BitsPerPixel()
+	buf := make([]byte, hdr.rowLen(region.Dx()))
+	for {
+		row, err := d.Next()
+		if err != nil {
+			return ioutilx.NoEOF(err)
+		}
+		if row.Y < region.Min.Y {
+			continue
+		}
+		cropRow(buf, row.Pix, region.Min.X, region.Dx(), bpp)
+		if err := w.writeRow(buf); err != nil {
+			return err
+		}
+		if row.Y == region.Max.Y-1 {
+			return nil
+		}
+	}
+}
+
+// cropInterlaced crops the region of an interlaced image. The pixels of the
+// region are gathered from all passes before they are written.
+func cropInterlaced(d *Decoder, w rowWriter, region image.Rectangle) error {
+	hdr := d.Header()
+	bpp := hdr.BitsPerPixel()
+	rows := make([][]byte, region.Dy())
+	for i := range rows {
+		rows[i] = make([]byte, hdr.rowLen(region.Dx()))
+	}
+	for {
+		row, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if row.Y >= region.Min.Y && row.Y < region.Max.Y {
+			// Index of the first pixel of the row within the region
+			i := 0
+			if row.X < region.Min.X {
+				i = (region.Min.X - row.X + row.DX - 1) / row.DX
+			}
+			for ; i < row.Width && row.X+i*row.DX < region.Max.X; i++ {
+				copyPixel(rows[row.Y-region.Min.Y], row.X+i*row.DX-region.Min.X, row.Pix, i, bpp)
+			}
+		}
+		if row.Pass == len(adam7) && row.Y >= region.Max.Y-1 {
+			// Rows of the last pass come after all rows of earlier passes
+			break
+		}
+	}
+	for _, row := range rows {
+		if err := w.writeRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cropRow copies the n pixels of row that start at pixel x to dst. Pixels of
+// less than 8 bits are shifted to the start of dst, and the unused bits of its
+// last byte are cleared.
+func cropRow(dst, row []byte, x, n, bpp int) {
+	start, shift := x*bpp/8, uint(x*bpp%8)
+	if shift == 0 {
+		copy(dst, row[start:])
+	} else {
+		for i := range dst {
+			v := row[start+i] << shift
+			if start+i+1 < len(row) {
+				v |= row[start+i+1] >> (8 - shift)
+			}
+			dst[i] = v
+		}
+	}
+	if rem := uint(n * bpp % 8); rem != 0 {
+		dst[len(dst)-1] &= 0xff << (8 - rem)
+	}
+}
+
+// copyPixel copies pixel i of src to pixel x of dst.
+func copyPixel(dst []byte, x int, src []byte, i, bpp int) {
+	if bpp >= 8 {
+		n := bpp / 8
+		copy(dst[x*n:(x+1)*n], src[i*n:])
+		return
+	}
+	mask := byte(1)<<uint(bpp) - 1
+	v := src[i*bpp/8] >> (8 - uint(bpp) - uint(i*bpp%8)) & mask
+	shift := 8 - uint(bpp) - uint(x*bpp%8)
+	dst[x*bpp/8] = dst[x*bpp/8]&^(mask<<shift) | v<<shift
+}
+
+// rowWriter writes the rows of a cropped image, which hold samples in the
+// layout of Row.Pix.
+type rowWriter interface {
+	writeRow(row []byte) error
+	close() error
+}
+
+// newRowWriter writes the header of an image with the header h in the
+// provided format to w, and returns a writer for its rows.
+func newRowWriter(w io.Writer, h Header, format Format) (rowWriter, error) {
+	switch format {
+	case PNG:
+		enc, err := newEncoder(w, h)
+		if err != nil {
+			return nil, err
+		}
+		return enc, nil
+	case BMP:
+		enc, err := bmpx.NewEncoder(w, h.Width, h.Height, hasAlpha(h))
+		if err != nil {
+			return nil, err
+		}
+		return &nrgbaWriter{hdr: h, enc: enc}, nil
+	case TIFF:
+		enc, err := tiffx.NewEncoder(w, image.Config{Width: h.Width, Height: h.Height, ColorModel: color.NRGBAModel})
+		if err != nil {
+			return nil, err
+		}
+		return &nrgbaWriter{hdr: h, enc: enc}, nil
+	}
+	return nil, errors.New("unsupported format")
+}
+
+// hasAlpha reports whether an image with the header h may have pixels that
+// are not opaque.
+func hasAlpha(h Header) bool {
+	switch {
+	case h.ColorType == GrayAlpha, h.ColorType == RGBA, len(h.Transparent) > 0:
+		return true
+	}
+	for _, c := range h.Palette {
+		if _, _, _, a := c.RGBA(); a != 0xffff {
+			return true
+		}
+	}
+	return false
+}
+
+// nrgbaWriter converts rows to 8-bit NRGBA before writing them to an encoder
+// of another format.
+type nrgbaWriter struct {
+	hdr Header
+	buf []byte
+	enc interface {
+		WriteRow(row []byte) error
+		Close() error
+	}
+}
+
+func (w *nrgbaWriter) writeRow(row []byte) error {
+	w.buf = w.hdr.AppendNRGBA(w.buf[:0], row, 0, w.hdr.Width)
+	return w.enc.WriteRow(w.buf)
+}
+
+func (w *nrgbaWriter) close() error {
+	return w.enc.Close()
+}
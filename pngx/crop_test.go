@@ -0,0 +1,109 @@
+package pngx
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func TestCrop(t *testing.T) {
+	for _, f := range testFormats {
+		for _, depth := range f.depths {
+			t.Run(fmt.Sprintf("type%d/depth%d", f.colorType, depth), func(t *testing.T) {
+				for i := 0; i < 20; i++ {
+					h := randHeader(f.colorType, depth, i%2 == 1)
+					rows := randRows(h)
+					src := encodeTestPNG(h, rows)
+
+					x0, y0 := rand.Intn(h.Width), rand.Intn(h.Height)
+					region := image.Rect(x0, y0, x0+1+rand.Intn(h.Width-x0), y0+1+rand.Intn(h.Height-y0))
+					want := h
+					want.Width, want.Height = region.Dx(), region.Dy()
+					want.Interlaced = false
+					wantRows := make([][]byte, region.Dy())
+					for y := range wantRows {
+						wantRows[y] = make([]byte, want.rowLen(want.Width))
+						for x := 0; x < want.Width; x++ {
+							setPixel(h, wantRows[y], x, getPixel(h, rows[region.Min.Y+y], region.Min.X+x))
+						}
+					}
+
+					// PNG output keeps the samples of the input
+					var dst bytes.Buffer
+					require.NoError(t, Crop(bytes.NewReader(src), &dst, region))
+					testDecode(t, dst.Bytes(), want, wantRows)
+
+					// BMP and TIFF output hold the colors of the input
+					for _, format := range []Format{BMP, TIFF} {
+						dst.Reset()
+						require.NoError(t, CropWithOptions(bytes.NewReader(src), &dst, region, &Options{Format: format}))
+						var img image.Image
+						var err error
+						if format == BMP {
+							img, err = bmp.Decode(&dst)
+						} else {
+							img, err = tiff.Decode(bytes.NewReader(dst.Bytes()))
+						}
+						require.NoError(t, err)
+						require.Equal(t, region.Size(), img.Bounds().Size())
+						for y, row := range wantRows {
+							pix := want.AppendNRGBA(nil, row, 0, want.Width)
+							for x := 0; x < want.Width; x++ {
+								got := toNRGBA(img.At(x, y))
+								if pix[4*x+3] == 0 {
+									// The color of transparent pixels is not kept
+									require.Zero(t, got.A)
+									continue
+								}
+								require.Equal(t, pix[4*x:4*x+4], []byte{got.R, got.G, got.B, got.A}, "format %d pixel %d,%d", format, x, y)
+							}
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCropStopsAfterRegion(t *testing.T) {
+	h := Header{Width: 200, Height: 2000, BitDepth: 8, ColorType: RGB}
+	src := encodeTestPNG(h, randRows(h))
+
+	cr := &countingReader{r: bytes.NewReader(src)}
+	var dst bytes.Buffer
+	region := image.Rect(50, 10, 150, 100)
+	require.NoError(t, Crop(cr, &dst, region))
+	require.Less(t, cr.n, len(src)/10)
+
+	img, err := png.Decode(&dst)
+	require.NoError(t, err)
+	require.Equal(t, region.Size(), img.Bounds().Size())
+}
+
+func TestCropInvalid(t *testing.T) {
+	h := Header{Width: 10, Height: 10, BitDepth: 8, ColorType: Gray}
+	src := encodeTestPNG(h, randRows(h))
+	require.Error(t, Crop(bytes.NewReader(src), io.Discard, image.Rect(10, 0, 20, 10)))
+	require.Error(t, CropWithOptions(bytes.NewReader(src), io.Discard, image.Rect(0, 0, 5, 5), &Options{Format: 10}))
+	require.Error(t, Crop(bytes.NewReader(src[:len(src)/2]), io.Discard, image.Rect(0, 0, 10, 10)))
+}
+
+// countingReader counts the number of bytes that are read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+	return n, err
+}
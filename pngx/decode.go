@@ -0,0 +1,553 @@
+// Package pngx decodes PNG images one row at a time, without holding the
+// image in memory.
+package pngx
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image/color"
+	"io"
+
+	"github.com/sebnyberg/imgcrop/internal/ioutilx"
+)
+
+// ColorType is the color type of a PNG image, which determines the samples of
+// each pixel.
+type ColorType uint8
+
+const (
+	Gray      ColorType = 0 // One gray sample
+	RGB       ColorType = 2 // Red, green and blue samples
+	Paletted  ColorType = 3 // One palette index
+	GrayAlpha ColorType = 4 // Gray and alpha samples
+	RGBA      ColorType = 6 // Red, green, blue and alpha samples
+)
+
+// samples returns the number of samples per pixel of the color type.
+func (c ColorType) samples() int {
+	switch c {
+	case RGB:
+		return 3
+	case GrayAlpha:
+		return 2
+	case RGBA:
+		return 4
+	}
+	return 1
+}
+
+// Header is the header of a PNG image, with the chunks that are needed to
+// interpret its pixels.
+type Header struct {
+	Width, Height int
+	BitDepth      int
+	ColorType     ColorType
+	Interlaced    bool
+
+	// Palette is the palette of a Paletted image, with the alpha of each color
+	// taken from the tRNS chunk, if any.
+	Palette color.Palette
+
+	// Transparent holds the gray sample, or the red, green and blue samples,
+	// of the single transparent color of a Gray or RGB image. It is nil when
+	// the image has no tRNS chunk.
+	Transparent []uint16
+}
+
+// BitsPerPixel returns the number of bits of each pixel.
+func (h Header) BitsPerPixel() int {
+	return h.BitDepth * h.ColorType.samples()
+}
+
+// rowLen returns the number of bytes of a row of width pixels, excluding the
+// filter type byte.
+func (h Header) rowLen(width int) int {
+	return (width*h.BitsPerPixel() + 7) / 8
+}
+
+const (
+	pngHeader = "\x89PNG\r\n\x1a\n"
+
+	// maxRowLen is the maximum number of bytes of a row. It guards against
+	// allocating huge rows for corrupt headers.
+	maxRowLen = 1 << 28
+)
+
+// Filter types of rows
+const (
+	filterNone    = 0
+	filterSub     = 1
+	filterUp      = 2
+	filterAverage = 3
+	filterPaeth   = 4
+)
+
+// adam7 holds the offset and spacing of the pixels of each pass of Adam7
+// interlacing.
+var adam7 = [7]struct{ x, y, dx, dy int }{
+	{0, 0, 8, 8},
+	{4, 0, 8, 8},
+	{0, 4, 4, 8},
+	{2, 0, 4, 4},
+	{0, 2, 2, 4},
+	{1, 0, 2, 2},
+	{0, 1, 1, 2},
+}
+
+// Row is a row of pixels that is returned by Decoder.Next.
+type Row struct {
+	// Pass is the Adam7 pass of the row, from 1 to 7, or 0 if the image is not
+	// interlaced.
+	Pass int
+
+	// Y is the y coordinate of the row in the image, and pixel i of the row is
+	// at x coordinate X+i*DX. Rows of images that are not interlaced start at
+	// X=0 with DX=1.
+	Y     int
+	X, DX int
+	Width int
+
+	// Pix holds the unfiltered samples of the row, as stored in the PNG.
+	// Samples of less than 8 bits are packed with the leftmost pixel in the
+	// high bits, and 16-bit samples are big-endian.
+	Pix []byte
+}
+
+// Decoder decodes the rows of a PNG image in the order that they are stored.
+//
+// Besides the decompressor, a Decoder holds two rows of the image, the row
+// that is being decoded and the row above it that it may be filtered against.
+type Decoder struct {
+	hdr Header
+	r   *bufio.Reader
+	crc hash.Hash32
+	tmp [8]byte
+
+	idat *idatReader
+	zr   io.ReadCloser
+
+	pass     int // Index of the current pass in adam7, 0 if not interlaced
+	y        int // Index of the next row of the current pass
+	cur      []byte
+	prev     []byte
+	finished bool
+}
+
+// NewDecoder reads the header of the PNG in r, and the chunks up to its image
+// data. Rows are then decoded by Next.
+func NewDecoder(r io.Reader) (*Decoder, error) {
+	d := &Decoder{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	if _, err := io.ReadFull(d.r, d.tmp[:len(pngHeader)]); err != nil {
+		return nil, ioutilx.NoEOF(err)
+	}
+	if string(d.tmp[:len(pngHeader)]) != pngHeader {
+		return nil, errors.New("png: invalid format")
+	}
+	for i := 0; ; i++ {
+		length, typ, err := d.readChunkHeader()
+		if err != nil {
+			return nil, err
+		}
+		if (i == 0) != (typ == "IHDR") {
+			return nil, errors.New("png: IHDR must be the first chunk")
+		}
+		switch typ {
+		case "IHDR":
+			err = d.parseIHDR(length)
+		case "PLTE":
+			err = d.parsePLTE(length)
+		case "tRNS":
+			err = d.parseTRNS(length)
+		case "IDAT":
+			if d.hdr.ColorType == Paletted && len(d.hdr.Palette) == 0 {
+				return nil, errors.New("png: missing palette")
+			}
+			d.idat = &idatReader{d: d, left: length}
+			d.zr, err = zlib.NewReader(d.idat)
+			if err != nil {
+				return nil, err
+			}
+			d.start()
+			return d, nil
+		case "IEND":
+			return nil, errors.New("png: missing image data")
+		default:
+			err = d.skipChunk(length)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Header returns the header of the image.
+func (d *Decoder) Header() Header {
+	return d.hdr
+}
+
+// Next decodes and returns the next row of the image. The pixels of the row
+// are only valid until the next call to Next. Next returns io.EOF after the
+// last row, once the remaining chunks of the image have been verified.
+//
+// Rows of images that are not interlaced are returned from top to bottom.
+// Rows of interlaced images are returned pass by pass, so every row of the
+// image but the first is returned more than once, with different pixels.
+func (d *Decoder) Next() (Row, error) {
+	for d.hdr.Interlaced && d.pass < len(adam7) && d.y >= d.passHeight() {
+		d.pass++
+		if d.pass < len(adam7) {
+			d.start()
+		}
+	}
+	if d.finished || d.y >= d.passHeight() {
+		return Row{}, d.finish()
+	}
+
+	width := d.passWidth()
+	n := d.hdr.rowLen(width)
+	if _, err := io.ReadFull(d.zr, d.cur[:1+n]); err != nil {
+		return Row{}, ioutilx.NoEOF(err)
+	}
+	d.cur = d.cur[:1+n]
+	if err := unfilter(d.cur, d.prev, (d.hdr.BitsPerPixel()+7)/8); err != nil {
+		return Row{}, err
+	}
+	row := Row{Y: d.y, DX: 1, Width: width, Pix: d.cur[1:]}
+	if d.hdr.Interlaced {
+		p := adam7[d.pass]
+		row.Pass = d.pass + 1
+		row.Y = p.y + d.y*p.dy
+		row.X = p.x
+		row.DX = p.dx
+	}
+	d.y++
+	d.cur, d.prev = d.prev, d.cur
+	return row, nil
+}
+
+// Close releases the decompressor of d. It does not close the underlying
+// reader.
+func (d *Decoder) Close() error {
+	return d.zr.Close()
+}
+
+// start prepares the row buffers for the first row of the current pass, which
+// is filtered against a row of zeros.
+func (d *Decoder) start() {
+	n := 1 + d.hdr.rowLen(d.passWidth())
+	if cap(d.cur) < n {
+		d.cur = make([]byte, n)
+		d.prev = make([]byte, n)
+	}
+	d.cur = d.cur[:n]
+	d.prev = d.prev[:n]
+	for i := range d.prev {
+		d.prev[i] = 0
+	}
+	d.y = 0
+}
+
+// passWidth returns the number of pixels per row of the current pass.
+func (d *Decoder) passWidth() int {
+	if !d.hdr.Interlaced {
+		return d.hdr.Width
+	}
+	p := adam7[d.pass]
+	return (d.hdr.Width - p.x + p.dx - 1) / p.dx
+}
+
+// passHeight returns the number of rows of the current pass, which is zero for
+// passes without pixels.
+func (d *Decoder) passHeight() int {
+	if !d.hdr.Interlaced {
+		return d.hdr.Height
+	}
+	if d.pass >= len(adam7) {
+		return 0
+	}
+	p := adam7[d.pass]
+	if d.passWidth() <= 0 {
+		return 0
+	}
+	return (d.hdr.Height - p.y + p.dy - 1) / p.dy
+}
+
+// finish verifies that the image data ends after the last row, and reads the
+// remaining chunks of the image up to IEND.
+func (d *Decoder) finish() error {
+	if d.finished {
+		return io.EOF
+	}
+	d.finished = true
+	if n, err := d.zr.Read(d.tmp[:1]); n > 0 || err != io.EOF {
+		if err == nil || err == io.EOF {
+			err = errors.New("png: too much pixel data")
+		}
+		return err
+	}
+	// Skip any remaining (empty) IDAT chunks
+	if _, err := io.Copy(io.Discard, d.idat); err != nil {
+		return err
+	}
+	for {
+		length, typ, err := d.readChunkHeader()
+		if err != nil {
+			return err
+		}
+		if typ == "IEND" {
+			if err := d.skipChunk(length); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		if typ == "IDAT" {
+			return errors.New("png: too much pixel data")
+		}
+		if err := d.skipChunk(length); err != nil {
+			return err
+		}
+	}
+}
+
+// readChunkHeader reads the length and type of the next chunk, and resets the
+// CRC for the chunk data.
+func (d *Decoder) readChunkHeader() (uint32, string, error) {
+	if _, err := io.ReadFull(d.r, d.tmp[:8]); err != nil {
+		return 0, "", ioutilx.NoEOF(err)
+	}
+	length := binary.BigEndian.Uint32(d.tmp[:4])
+	if length > 1<<31-1 {
+		return 0, "", errors.New("png: invalid chunk length")
+	}
+	d.crc.Reset()
+	d.crc.Write(d.tmp[4:8])
+	return length, string(d.tmp[4:8]), nil
+}
+
+// readChunk reads the length bytes of data of the current chunk into b, and
+// verifies its CRC.
+func (d *Decoder) readChunk(b []byte) error {
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return ioutilx.NoEOF(err)
+	}
+	d.crc.Write(b)
+	return d.verifyCRC()
+}
+
+// skipChunk skips the length bytes of data of the current chunk, and verifies
+// its CRC.
+func (d *Decoder) skipChunk(length uint32) error {
+	if _, err := io.CopyN(d.crc, d.r, int64(length)); err != nil {
+		return ioutilx.NoEOF(err)
+	}
+	return d.verifyCRC()
+}
+
+// verifyCRC reads the CRC that follows the data of a chunk and compares it to
+// the CRC of the data that has been read.
+func (d *Decoder) verifyCRC() error {
+	if _, err := io.ReadFull(d.r, d.tmp[:4]); err != nil {
+		return ioutilx.NoEOF(err)
+	}
+	if binary.BigEndian.Uint32(d.tmp[:4]) != d.crc.Sum32() {
+		return errors.New("png: invalid checksum")
+	}
+	return nil
+}
+
+func (d *Decoder) parseIHDR(length uint32) error {
+	if length != 13 {
+		return errors.New("png: invalid IHDR length")
+	}
+	var b [13]byte
+	if err := d.readChunk(b[:]); err != nil {
+		return err
+	}
+	width := binary.BigEndian.Uint32(b[0:4])
+	height := binary.BigEndian.Uint32(b[4:8])
+	if width == 0 || height == 0 || width > 1<<31-1 || height > 1<<31-1 {
+		return errors.New("png: invalid dimensions")
+	}
+	if b[10] != 0 || b[11] != 0 || b[12] > 1 {
+		return errors.New("png: unsupported compression, filter or interlace method")
+	}
+	d.hdr = Header{
+		Width:      int(width),
+		Height:     int(height),
+		BitDepth:   int(b[8]),
+		ColorType:  ColorType(b[9]),
+		Interlaced: b[12] == 1,
+	}
+	valid := false
+	switch d.hdr.ColorType {
+	case Gray:
+		valid = d.hdr.BitDepth == 1 || d.hdr.BitDepth == 2 || d.hdr.BitDepth == 4 || d.hdr.BitDepth == 8 || d.hdr.BitDepth == 16
+	case Paletted:
+		valid = d.hdr.BitDepth == 1 || d.hdr.BitDepth == 2 || d.hdr.BitDepth == 4 || d.hdr.BitDepth == 8
+	case RGB, GrayAlpha, RGBA:
+		valid = d.hdr.BitDepth == 8 || d.hdr.BitDepth == 16
+	}
+	if !valid {
+		return fmt.Errorf("png: invalid bit depth %d of color type %d", d.hdr.BitDepth, d.hdr.ColorType)
+	}
+	if int64(width)*int64(d.hdr.BitsPerPixel())/8 > maxRowLen {
+		return errors.New("png: unsupported image width")
+	}
+	return nil
+}
+
+func (d *Decoder) parsePLTE(length uint32) error {
+	if length%3 != 0 || length == 0 || length > 3*256 {
+		return errors.New("png: invalid PLTE length")
+	}
+	var b [3 * 256]byte
+	if err := d.readChunk(b[:length]); err != nil {
+		return err
+	}
+	if d.hdr.ColorType != Paletted {
+		// The palette is only a suggestion for other color types
+		return nil
+	}
+	d.hdr.Palette = make(color.Palette, length/3)
+	for i := range d.hdr.Palette {
+		d.hdr.Palette[i] = color.NRGBA{b[3*i], b[3*i+1], b[3*i+2], 0xff}
+	}
+	return nil
+}
+
+func (d *Decoder) parseTRNS(length uint32) error {
+	var b [256]byte
+	if length > uint32(len(b)) {
+		return errors.New("png: invalid tRNS length")
+	}
+	if err := d.readChunk(b[:length]); err != nil {
+		return err
+	}
+	switch d.hdr.ColorType {
+	case Gray, RGB:
+		n := d.hdr.ColorType.samples()
+		if int(length) != 2*n {
+			return errors.New("png: invalid tRNS length")
+		}
+		d.hdr.Transparent = make([]uint16, n)
+		for i := range d.hdr.Transparent {
+			d.hdr.Transparent[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+	case Paletted:
+		if int(length) > len(d.hdr.Palette) {
+			return errors.New("png: invalid tRNS length")
+		}
+		for i, a := range b[:length] {
+			c := d.hdr.Palette[i].(color.NRGBA)
+			c.A = a
+			d.hdr.Palette[i] = c
+		}
+	default:
+		return errors.New("png: tRNS chunk with alpha channel")
+	}
+	return nil
+}
+
+// idatReader reads the data of consecutive IDAT chunks, verifying the CRC of
+// each chunk.
+type idatReader struct {
+	d    *Decoder
+	left uint32 // Bytes left of the current chunk
+	done bool
+}
+
+func (r *idatReader) Read(p []byte) (int, error) {
+	for r.left == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.d.verifyCRC(); err != nil {
+			return 0, err
+		}
+		// Peek at the type of the next chunk, which is only consumed if it
+		// continues the image data
+		b, err := r.d.r.Peek(8)
+		if err != nil {
+			return 0, ioutilx.NoEOF(err)
+		}
+		if string(b[4:8]) != "IDAT" {
+			r.done = true
+			return 0, io.EOF
+		}
+		length, _, err := r.d.readChunkHeader()
+		if err != nil {
+			return 0, err
+		}
+		r.left = length
+	}
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.d.r.Read(p)
+	r.d.crc.Write(p[:n])
+	r.left -= uint32(n)
+	return n, ioutilx.NoEOF(err)
+}
+
+// unfilter reverses the filter of row, whose first byte is the filter type,
+// given the unfiltered row above it and the number of bytes per pixel
+// (rounded up).
+func unfilter(row, prev []byte, bpp int) error {
+	cdat, pdat := row[1:], prev[1:]
+	switch row[0] {
+	case filterNone:
+	case filterSub:
+		for i := bpp; i < len(cdat); i++ {
+			cdat[i] += cdat[i-bpp]
+		}
+	case filterUp:
+		for i, p := range pdat {
+			cdat[i] += p
+		}
+	case filterAverage:
+		for i := 0; i < bpp && i < len(cdat); i++ {
+			cdat[i] += pdat[i] / 2
+		}
+		for i := bpp; i < len(cdat); i++ {
+			cdat[i] += uint8((int(cdat[i-bpp]) + int(pdat[i])) / 2)
+		}
+	case filterPaeth:
+		for i := range cdat {
+			var a, c int
+			if i >= bpp {
+				a, c = int(cdat[i-bpp]), int(pdat[i-bpp])
+			}
+			cdat[i] += paeth(a, int(pdat[i]), c)
+		}
+	default:
+		return errors.New("png: invalid filter type")
+	}
+	return nil
+}
+
+// paeth returns the one of a (left), b (above) and c (upper left) that is
+// closest to a+b-c.
+func paeth(a, b, c int) uint8 {
+	pa := abs(b - c)
+	pb := abs(a - c)
+	pc := abs(a + b - 2*c)
+	if pa <= pb && pa <= pc {
+		return uint8(a)
+	}
+	if pb <= pc {
+		return uint8(b)
+	}
+	return uint8(c)
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,338 @@
+package pngx
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image/color"
+	"image/png"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testFormats = []struct {
+	colorType ColorType
+	depths    []int
+}{
+	{Gray, []int{1, 2, 4, 8, 16}},
+	{RGB, []int{8, 16}},
+	{Paletted, []int{1, 2, 4, 8}},
+	{GrayAlpha, []int{8, 16}},
+	{RGBA, []int{8, 16}},
+}
+
+func TestDecoder(t *testing.T) {
+	for _, f := range testFormats {
+		for _, depth := range f.depths {
+			for _, interlaced := range []bool{false, true} {
+				name := fmt.Sprintf("type%d/depth%d/interlaced=%v", f.colorType, depth, interlaced)
+				t.Run(name, func(t *testing.T) {
+					for i := 0; i < 10; i++ {
+						h := randHeader(f.colorType, depth, interlaced)
+						rows := randRows(h)
+						src := encodeTestPNG(h, rows)
+						testDecode(t, src, h, rows)
+					}
+				})
+			}
+		}
+	}
+}
+
+// testDecode decodes src and compares the rows to rows, and the colors to
+// those decoded by image/png.
+func testDecode(t *testing.T, src []byte, h Header, rows [][]byte) {
+	d, err := NewDecoder(bytes.NewReader(src))
+	require.NoError(t, err)
+	require.Equal(t, h, d.Header())
+
+	got := make([][]byte, h.Height)
+	for y := range got {
+		got[y] = make([]byte, h.rowLen(h.Width))
+	}
+	lastY, lastPass := -1, 0
+	for {
+		row, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		// Rows are returned in the order they are stored
+		if row.Pass == lastPass {
+			require.Greater(t, row.Y, lastY)
+		} else {
+			require.Greater(t, row.Pass, lastPass)
+		}
+		lastY, lastPass = row.Y, row.Pass
+		require.Equal(t, h.rowLen(row.Width), len(row.Pix))
+		for i := 0; i < row.Width; i++ {
+			setPixel(h, got[row.Y], row.X+i*row.DX, getPixel(h, row.Pix, i))
+		}
+	}
+	require.Equal(t, rows, got)
+	_, err = d.Next()
+	require.Equal(t, io.EOF, err)
+	require.NoError(t, d.Close())
+
+	img, err := png.Decode(bytes.NewReader(src))
+	require.NoError(t, err)
+	for y, row := range rows {
+		pix := h.AppendNRGBA(nil, row, 0, h.Width)
+		for x := 0; x < h.Width; x++ {
+			want := toNRGBA(img.At(x, y))
+			require.Equal(t, want, color.NRGBA{pix[4*x], pix[4*x+1], pix[4*x+2], pix[4*x+3]}, "pixel %d,%d", x, y)
+		}
+	}
+}
+
+func TestDecoderChunks(t *testing.T) {
+	h := randHeader(RGB, 8, false)
+	rows := randRows(h)
+	src := encodeTestPNG(h, rows)
+
+	// Ancillary chunks are skipped before and after the image data
+	var b bytes.Buffer
+	b.Write(src[:8+25])
+	writeChunk(&b, "tEXt", []byte("Comment\x00hello"))
+	b.Write(src[8+25 : len(src)-12])
+	writeChunk(&b, "tIME", make([]byte, 7))
+	b.Write(src[len(src)-12:])
+	testDecode(t, b.Bytes(), h, rows)
+}
+
+func TestDecoderInvalid(t *testing.T) {
+	h := randHeader(RGBA, 8, true)
+	h.Width, h.Height = 20, 20
+	src := encodeTestPNG(h, randRows(h))
+
+	decodeAll := func(src []byte) error {
+		d, err := NewDecoder(bytes.NewReader(src))
+		if err != nil {
+			return err
+		}
+		for {
+			if _, err := d.Next(); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	require.NoError(t, decodeAll(src))
+
+	for _, tc := range []struct {
+		name   string
+		modify func(b []byte) []byte
+	}{
+		{"signature", func(b []byte) []byte { b[1] = 'J'; return b }},
+		{"IHDR checksum", func(b []byte) []byte { b[8+8+12]++; return b }},
+		{"bit depth", func(b []byte) []byte { return withIHDR(b, func(ihdr []byte) { ihdr[8] = 4 }) }},
+		{"width", func(b []byte) []byte { return withIHDR(b, func(ihdr []byte) { ihdr[0] = 0x80 }) }},
+		{"interlace method", func(b []byte) []byte { return withIHDR(b, func(ihdr []byte) { ihdr[12] = 2 }) }},
+		{"IDAT checksum", func(b []byte) []byte { b[len(b)-12-1]++; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)/2] }},
+		{"missing IEND", func(b []byte) []byte { return b[:len(b)-12] }},
+	} {
+		err := decodeAll(tc.modify(append([]byte{}, src...)))
+		require.Error(t, err, tc.name)
+	}
+}
+
+func TestUnfilterInvalid(t *testing.T) {
+	row := []byte{5, 1, 2, 3}
+	require.Error(t, unfilter(row, make([]byte, len(row)), 1))
+}
+
+// withIHDR modifies the IHDR data of the PNG in b and updates its checksum.
+func withIHDR(b []byte, modify func(ihdr []byte)) []byte {
+	modify(b[16:29])
+	binary.BigEndian.PutUint32(b[29:], crc32.ChecksumIEEE(b[12:29]))
+	return b
+}
+
+func randHeader(colorType ColorType, depth int, interlaced bool) Header {
+	h := Header{
+		Width:      1 + rand.Intn(40),
+		Height:     1 + rand.Intn(40),
+		BitDepth:   depth,
+		ColorType:  colorType,
+		Interlaced: interlaced,
+	}
+	max := 1<<depth - 1
+	switch colorType {
+	case Paletted:
+		h.Palette = make(color.Palette, 1+rand.Intn(max+1))
+		alpha := rand.Intn(len(h.Palette) + 1)
+		for i := range h.Palette {
+			a := uint8(0xff)
+			if i < alpha {
+				a = uint8(rand.Intn(256))
+			}
+			h.Palette[i] = color.NRGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), a}
+		}
+	case Gray, RGB:
+		if rand.Intn(2) == 0 {
+			h.Transparent = make([]uint16, colorType.samples())
+			for i := range h.Transparent {
+				// Few values so that some pixels are transparent
+				h.Transparent[i] = uint16(rand.Intn(2) * max)
+			}
+		}
+	}
+	return h
+}
+
+// randRows returns random rows of an image with the header h.
+func randRows(h Header) [][]byte {
+	rows := make([][]byte, h.Height)
+	for y := range rows {
+		rows[y] = make([]byte, h.rowLen(h.Width))
+		for x := 0; x < h.Width; x++ {
+			var v uint64
+			switch {
+			case h.ColorType == Paletted:
+				v = uint64(rand.Intn(len(h.Palette)))
+			case h.Transparent != nil:
+				// Samples of 0 or max, so that some pixels match the
+				// transparent color
+				max := uint64(1)<<h.BitDepth - 1
+				for i := 0; i < h.ColorType.samples(); i++ {
+					v = v<<h.BitDepth | uint64(rand.Intn(2))*max
+				}
+			default:
+				v = rand.Uint64() & (1<<h.BitsPerPixel() - 1)
+			}
+			setPixel(h, rows[y], x, v)
+		}
+	}
+	return rows
+}
+
+// getPixel returns the bits of pixel x of the packed row.
+func getPixel(h Header, row []byte, x int) uint64 {
+	bpp := h.BitsPerPixel()
+	var v uint64
+	for i := 0; i < bpp; i++ {
+		bit := x*bpp + i
+		v = v<<1 | uint64(row[bit/8]>>(7-bit%8)&1)
+	}
+	return v
+}
+
+// setPixel sets the bits of pixel x of the packed row to v.
+func setPixel(h Header, row []byte, x int, v uint64) {
+	bpp := h.BitsPerPixel()
+	for i := 0; i < bpp; i++ {
+		bit := x*bpp + i
+		b := byte(v>>(bpp-1-i)&1) << (7 - bit%8)
+		row[bit/8] = row[bit/8]&^(1<<(7-bit%8)) | b
+	}
+}
+
+// encodeTestPNG encodes the rows of an image with the header h, using random
+// filters and splitting the image data into IDAT chunks of random sizes.
+func encodeTestPNG(h Header, rows [][]byte) []byte {
+	var b bytes.Buffer
+	b.WriteString(pngHeader)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(h.Width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h.Height))
+	ihdr[8] = byte(h.BitDepth)
+	ihdr[9] = byte(h.ColorType)
+	if h.Interlaced {
+		ihdr[12] = 1
+	}
+	writeChunk(&b, "IHDR", ihdr)
+	if h.ColorType == Paletted {
+		var plte, trns []byte
+		for _, c := range h.Palette {
+			c := c.(color.NRGBA)
+			plte = append(plte, c.R, c.G, c.B)
+			trns = append(trns, c.A)
+		}
+		writeChunk(&b, "PLTE", plte)
+		for len(trns) > 0 && trns[len(trns)-1] == 0xff {
+			trns = trns[:len(trns)-1]
+		}
+		if len(trns) > 0 {
+			writeChunk(&b, "tRNS", trns)
+		}
+	}
+	if h.Transparent != nil {
+		trns := make([]byte, 2*len(h.Transparent))
+		for i, v := range h.Transparent {
+			binary.BigEndian.PutUint16(trns[2*i:], v)
+		}
+		writeChunk(&b, "tRNS", trns)
+	}
+
+	var data bytes.Buffer
+	zw := zlib.NewWriter(&data)
+	passes := []struct{ x, y, dx, dy int }{{0, 0, 1, 1}}
+	if h.Interlaced {
+		passes = adam7[:]
+	}
+	bpp := (h.BitsPerPixel() + 7) / 8
+	for _, p := range passes {
+		width := (h.Width - p.x + p.dx - 1) / p.dx
+		if width <= 0 {
+			continue
+		}
+		prev := make([]byte, h.rowLen(width))
+		for y := p.y; y < h.Height; y += p.dy {
+			cur := make([]byte, h.rowLen(width))
+			for i := 0; i < width; i++ {
+				setPixel(h, cur, i, getPixel(h, rows[y], p.x+i*p.dx))
+			}
+			filter := byte(rand.Intn(5))
+			zw.Write(append([]byte{filter}, applyFilter(filter, cur, prev, bpp)...))
+			prev = cur
+		}
+	}
+	zw.Close()
+	for data.Len() > 0 {
+		writeChunk(&b, "IDAT", data.Next(1+rand.Intn(64)))
+	}
+	writeChunk(&b, "IEND", nil)
+	return b.Bytes()
+}
+
+// applyFilter returns the row cur filtered with the provided filter type.
+func applyFilter(filter byte, cur, prev []byte, bpp int) []byte {
+	res := make([]byte, len(cur))
+	for i := range cur {
+		var a, c int
+		if i >= bpp {
+			a, c = int(cur[i-bpp]), int(prev[i-bpp])
+		}
+		b := int(prev[i])
+		switch filter {
+		case filterNone:
+			res[i] = cur[i]
+		case filterSub:
+			res[i] = cur[i] - uint8(a)
+		case filterUp:
+			res[i] = cur[i] - uint8(b)
+		case filterAverage:
+			res[i] = cur[i] - uint8((a+b)/2)
+		case filterPaeth:
+			res[i] = cur[i] - paeth(a, b, c)
+		}
+	}
+	return res
+}
+
+// toNRGBA converts a color decoded by image/png to 8-bit NRGBA, truncating
+// 16-bit colors like AppendNRGBA.
+func toNRGBA(c color.Color) color.NRGBA {
+	if c, ok := c.(color.NRGBA64); ok {
+		return color.NRGBA{uint8(c.R >> 8), uint8(c.G >> 8), uint8(c.B >> 8), uint8(c.A >> 8)}
+	}
+	return color.NRGBAModel.Convert(c).(color.NRGBA)
+}
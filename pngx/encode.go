@@ -0,0 +1,203 @@
+package pngx
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image/color"
+	"io"
+)
+
+// idatLen is the size of the IDAT chunks written by encoder.
+const idatLen = 1 << 15
+
+// encoder writes a PNG that is not interlaced one row at a time. Besides the
+// compressor, it holds the previous row and the candidate filtered rows of the
+// current row.
+type encoder struct {
+	w    io.Writer
+	hdr  Header
+	idat *bufio.Writer
+	zw   *zlib.Writer
+	rows int // Number of rows left to write
+
+	prev     []byte
+	filtered [5][]byte
+}
+
+// newEncoder writes the header of a PNG with the header h to w, and returns an
+// encoder for its rows. Rows hold samples in the layout of Row.Pix.
+func newEncoder(w io.Writer, h Header) (*encoder, error) {
+	e := &encoder{w: w, hdr: h, rows: h.Height}
+	if _, err := io.WriteString(w, pngHeader); err != nil {
+		return nil, err
+	}
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(h.Width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(h.Height))
+	ihdr[8] = uint8(h.BitDepth)
+	ihdr[9] = uint8(h.ColorType)
+	if err := writeChunk(w, "IHDR", ihdr[:]); err != nil {
+		return nil, err
+	}
+	if h.ColorType == Paletted {
+		if err := writePalette(w, h.Palette); err != nil {
+			return nil, err
+		}
+	}
+	if len(h.Transparent) > 0 {
+		trns := make([]byte, 2*len(h.Transparent))
+		for i, v := range h.Transparent {
+			binary.BigEndian.PutUint16(trns[2*i:], v)
+		}
+		if err := writeChunk(w, "tRNS", trns); err != nil {
+			return nil, err
+		}
+	}
+
+	n := 1 + h.rowLen(h.Width)
+	e.prev = make([]byte, n)
+	for i := range e.filtered {
+		e.filtered[i] = make([]byte, n)
+		e.filtered[i][0] = byte(i)
+	}
+	e.idat = bufio.NewWriterSize(&chunkWriter{w: w, typ: "IDAT"}, idatLen)
+	e.zw = zlib.NewWriter(e.idat)
+	return e, nil
+}
+
+// writePalette writes the PLTE chunk of p, and a tRNS chunk with the alpha of
+// its colors unless they are all opaque.
+func writePalette(w io.Writer, p color.Palette) error {
+	plte := make([]byte, 0, 3*len(p))
+	trns := make([]byte, 0, len(p))
+	last := 0
+	for i, c := range p {
+		c := color.NRGBAModel.Convert(c).(color.NRGBA)
+		plte = append(plte, c.R, c.G, c.B)
+		trns = append(trns, c.A)
+		if c.A != 0xff {
+			last = i + 1
+		}
+	}
+	if err := writeChunk(w, "PLTE", plte); err != nil {
+		return err
+	}
+	if last == 0 {
+		return nil
+	}
+	return writeChunk(w, "tRNS", trns[:last])
+}
+
+// writeRow filters and writes the next row of the image, top to bottom.
+func (e *encoder) writeRow(row []byte) error {
+	if len(row) != len(e.prev)-1 {
+		return errors.New("invalid row length")
+	}
+	if e.rows == 0 {
+		return errors.New("all rows have been written")
+	}
+	e.rows--
+	f := e.filter(row)
+	if _, err := e.zw.Write(f); err != nil {
+		return err
+	}
+	copy(e.prev[1:], row)
+	return nil
+}
+
+// filter returns the filtered row with the smallest sum of absolute
+// differences, like image/png. Rows of images with palettes or less than 8 bits
+// per sample are not filtered.
+func (e *encoder) filter(row []byte) []byte {
+	none := e.filtered[filterNone]
+	copy(none[1:], row)
+	if e.hdr.ColorType == Paletted || e.hdr.BitDepth < 8 {
+		return none
+	}
+	bpp := (e.hdr.BitsPerPixel() + 7) / 8
+	cdat, pdat := row, e.prev[1:]
+	best, bestSum := none, sumAbs(none[1:])
+	for typ := filterSub; typ <= filterPaeth; typ++ {
+		f := e.filtered[typ][1:]
+		for i := range cdat {
+			var a, c int
+			if i >= bpp {
+				a, c = int(cdat[i-bpp]), int(pdat[i-bpp])
+			}
+			b := int(pdat[i])
+			switch typ {
+			case filterSub:
+				f[i] = cdat[i] - uint8(a)
+			case filterUp:
+				f[i] = cdat[i] - uint8(b)
+			case filterAverage:
+				f[i] = cdat[i] - uint8((a+b)/2)
+			case filterPaeth:
+				f[i] = cdat[i] - paeth(a, b, c)
+			}
+		}
+		if sum := sumAbs(f); sum < bestSum {
+			best, bestSum = e.filtered[typ], sum
+		}
+	}
+	return best
+}
+
+// sumAbs returns the sum of the absolute values of b as signed bytes.
+func sumAbs(b []byte) int {
+	var sum int
+	for _, v := range b {
+		sum += abs(int(int8(v)))
+	}
+	return sum
+}
+
+// close writes the end of the image data and the IEND chunk. It does not
+// close the underlying writer.
+func (e *encoder) close() error {
+	if e.rows > 0 {
+		return errors.New("missing rows")
+	}
+	if err := e.zw.Close(); err != nil {
+		return err
+	}
+	if err := e.idat.Flush(); err != nil {
+		return err
+	}
+	return writeChunk(e.w, "IEND", nil)
+}
+
+// chunkWriter writes each call to Write as a chunk of type typ.
+type chunkWriter struct {
+	w   io.Writer
+	typ string
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if err := writeChunk(w.w, w.typ, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeChunk writes a chunk with the provided type and data to w.
+func writeChunk(w io.Writer, typ string, data []byte) error {
+	var b [8]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(len(data)))
+	copy(b[4:], typ)
+	crc := crc32.NewIEEE()
+	crc.Write(b[4:])
+	crc.Write(data)
+	if _, err := w.Write(b[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(b[:4], crc.Sum32())
+	_, err := w.Write(b[:4])
+	return err
+}
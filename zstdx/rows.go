@@ -0,0 +1,183 @@
+package zstdx
+
+import (
+	"errors"
+	"io"
+
+	seekable "github.com/SaveTheRbtz/zstd-seekable-format-go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sebnyberg/imgcrop/bmpx"
+)
+
+// RowOptions are the options of a RowWriter. A nil *RowOptions means the
+// defaults.
+type RowOptions struct {
+	// RowsPerFrame is the number of rows that are stored in each frame. Fewer
+	// rows per frame means that less data is decompressed when cropping a
+	// region with few rows, at the cost of a worse compression ratio. By
+	// default, frames hold about 1MiB of rows.
+	RowsPerFrame int
+
+	// Level is the compression level, zstd.SpeedDefault by default.
+	Level zstd.EncoderLevel
+}
+
+const (
+	// defaultFrameLen is the approximate size of frames with the default
+	// number of rows per frame.
+	defaultFrameLen = 1 << 20
+
+	// maxFrameLen is the maximum size of a frame. It matches the maximum size
+	// of a compressed frame accepted by the seekable zstd reader.
+	maxFrameLen = 128 << 20
+)
+
+// RowWriter compresses an image with fixed size rows to the zstd seekable
+// format such that each frame holds a whole number of rows. A cropper that
+// reads the stream through a SeekableReader then only decompresses the frames
+// that hold the rows of its region, without decompressing frames that merely
+// hold a part of the first or last row.
+//
+// The header is stored in a frame of its own, followed by frames of
+// RowOptions.RowsPerFrame rows each. Any bytes after the last row, such as a
+// trailing ICC profile of a BMP, are stored in frames of their own. No index
+// of rows is stored, since the seek table of the stream already maps the
+// offset of a row to the frame that holds it.
+type RowWriter struct {
+	offset       int64
+	rowSize      int
+	rows         int
+	rowsPerFrame int
+
+	enc *zstd.Encoder
+	w   seekable.Writer
+
+	n   int64  // Number of bytes written as frames
+	buf []byte // Bytes of the next frame
+}
+
+// NewRowWriter returns a writer that compresses a stream with a header of
+// offset bytes followed by rows rows of rowSize bytes to w. Close must be
+// called to write the last frame and the seek table.
+func NewRowWriter(w io.Writer, offset int64, rowSize, rows int, opts *RowOptions) (*RowWriter, error) {
+	if opts == nil {
+		opts = &RowOptions{}
+	}
+	if offset < 0 || offset > maxFrameLen || rowSize <= 0 || rows < 0 {
+		return nil, errors.New("invalid row layout")
+	}
+	rowsPerFrame := opts.RowsPerFrame
+	if rowsPerFrame <= 0 {
+		rowsPerFrame = defaultFrameLen / rowSize
+		if rowsPerFrame == 0 {
+			rowsPerFrame = 1
+		}
+	}
+	if int64(rowsPerFrame)*int64(rowSize) > maxFrameLen {
+		return nil, errors.New("unsupported frame size")
+	}
+	level := opts.Level
+	if level == 0 {
+		level = zstd.SpeedDefault
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+	if err != nil {
+		return nil, err
+	}
+	sw, err := seekable.NewWriter(w, enc)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return &RowWriter{
+		offset:       offset,
+		rowSize:      rowSize,
+		rows:         rows,
+		rowsPerFrame: rowsPerFrame,
+		enc:          enc,
+		w:            sw,
+	}, nil
+}
+
+// Write writes decompressed bytes of the stream. Frames are compressed and
+// written to the underlying writer as soon as they are complete.
+func (w *RowWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		m := int(w.boundary() - w.n - int64(len(w.buf)))
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if w.n+int64(len(w.buf)) == w.boundary() {
+			if err := w.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the last frame and the seek table. It does not
+// close the underlying writer.
+func (w *RowWriter) Close() error {
+	defer w.enc.Close()
+	if len(w.buf) > 0 {
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	if w.n < w.offset+int64(w.rows)*int64(w.rowSize) {
+		return io.ErrUnexpectedEOF
+	}
+	return w.w.Close()
+}
+
+// boundary returns the offset in the decompressed stream at which the frame
+// that starts at w.n ends.
+func (w *RowWriter) boundary() int64 {
+	if w.n < w.offset {
+		return w.offset
+	}
+	frameLen := int64(w.rowsPerFrame) * int64(w.rowSize)
+	end := w.offset + int64(w.rows)*int64(w.rowSize)
+	if w.n < end && w.n+frameLen > end {
+		return end
+	}
+	return w.n + frameLen
+}
+
+func (w *RowWriter) flush() error {
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	w.n += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// CompressBMP compresses the uncompressed BMP in src to a row-aligned seekable
+// zstd stream in dst, see RowWriter.
+func CompressBMP(src io.Reader, dst io.Writer, opts *RowOptions) error {
+	hdr, err := bmpx.DecodeHeader(src)
+	if err != nil {
+		return err
+	}
+	if hdr.RLE {
+		return errors.New("unsupported compression")
+	}
+	rowSize := (hdr.Config.Width*hdr.BitsPerPixel + 31) / 32 * 4
+	w, err := NewRowWriter(dst, int64(hdr.ImageOffset), rowSize, hdr.Config.Height, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(hdr.HeaderBytes); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		return err
+	}
+	return w.Close()
+}
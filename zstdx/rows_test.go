@@ -0,0 +1,107 @@
+package zstdx
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestRowWriter(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := 1 + rand.Intn(100)
+		h := 1 + rand.Intn(100)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+		src := b.Bytes()
+
+		rowsPerFrame := 1 + rand.Intn(8)
+		var compressed bytes.Buffer
+		require.NoError(t, CompressBMP(bytes.NewReader(src), &compressed, &RowOptions{RowsPerFrame: rowsPerFrame}))
+
+		// The stream is a valid zstd stream
+		dec, err := zstd.NewReader(bytes.NewReader(compressed.Bytes()))
+		require.NoError(t, err)
+		plain, err := io.ReadAll(dec)
+		dec.Close()
+		require.NoError(t, err)
+		require.Equal(t, src, plain)
+
+		// Each frame that holds a row of the region is read once, and no
+		// other frames are read
+		x0, y0 := rand.Intn(w), rand.Intn(h)
+		region := image.Rect(x0, y0, x0+1+rand.Intn(w-x0), y0+1+rand.Intn(h-y0))
+		frames := map[int]bool{0: true}
+		for y := region.Min.Y; y < region.Max.Y; y++ {
+			// Rows are stored bottom-up, after the frame of the header
+			frames[1+(h-1-y)/rowsPerFrame] = true
+		}
+		var wantCrop bytes.Buffer
+		require.NoError(t, bmpx.Crop(bytes.NewReader(src), &wantCrop, region))
+
+		cr := &countingReader{ReadSeeker: bytes.NewReader(compressed.Bytes())}
+		r, err := NewSeekableReader(cr)
+		require.NoError(t, err)
+		var got bytes.Buffer
+		require.NoError(t, bmpx.CropAt(r, &got, region))
+		require.Equal(t, wantCrop.Bytes(), got.Bytes())
+		require.Equal(t, len(frames), cr.calls)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestRowWriterTrailingBytes(t *testing.T) {
+	src := make([]byte, 10+4*7+5)
+	rand.Read(src)
+	var compressed bytes.Buffer
+	w, err := NewRowWriter(&compressed, 10, 4, 7, &RowOptions{RowsPerFrame: 2})
+	require.NoError(t, err)
+	for b := src; len(b) > 0; {
+		n := 1 + rand.Intn(len(b))
+		_, err := w.Write(b[:n])
+		require.NoError(t, err)
+		b = b[n:]
+	}
+	require.NoError(t, w.Close())
+
+	r, err := NewSeekableReader(bytes.NewReader(compressed.Bytes()))
+	require.NoError(t, err)
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, src, got)
+	require.NoError(t, r.Close())
+
+	// Rows 4 and 5 share a frame, while the last row and the trailing bytes
+	// are in frames of their own
+	cr := &countingReader{ReadSeeker: bytes.NewReader(compressed.Bytes())}
+	r, err = NewSeekableReader(cr)
+	require.NoError(t, err)
+	for _, tc := range []struct{ off, n, calls int }{
+		{10 + 4*5, 4, 1},
+		{10 + 4*4, 4, 1},
+		{10 + 4*6, 4, 2},
+		{10 + 4*7, 5, 3},
+	} {
+		b := make([]byte, tc.n)
+		_, err := r.ReadAt(b, int64(tc.off))
+		require.NoError(t, err)
+		require.Equal(t, src[tc.off:tc.off+tc.n], b)
+		require.Equal(t, tc.calls, cr.calls, "offset %d", tc.off)
+	}
+	require.NoError(t, r.Close())
+}
+
+func TestRowWriterMissingRows(t *testing.T) {
+	var compressed bytes.Buffer
+	w, err := NewRowWriter(&compressed, 10, 4, 7, nil)
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, 20))
+	require.NoError(t, err)
+	require.ErrorIs(t, w.Close(), io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,66 @@
+// Package zstdx provides zstd compressed sources and sinks for the croppers of
+// this module.
+package zstdx
+
+import (
+	"io"
+
+	seekable "github.com/SaveTheRbtz/zstd-seekable-format-go"
+	"github.com/klauspost/compress/zstd"
+)
+
+// SeekableReader reads the decompressed contents of a stream in the zstd
+// seekable format, such as a BMP that has been compressed to a .bmp.zst file
+// with github.com/SaveTheRbtz/zstd-seekable-format-go.
+//
+// Only the frames that hold the requested bytes are read and decompressed, so
+// a SeekableReader can be passed as the source of bmpx.Crop, which seeks past
+// rows outside of the cropping region, or of bmpx.CropAt and other croppers
+// that read from an io.ReaderAt. The most recently decompressed frame is
+// cached, so reading consecutive rows of the same frame decompresses it once.
+type SeekableReader struct {
+	r   seekable.Reader
+	dec *zstd.Decoder
+}
+
+// NewSeekableReader returns a reader of the seekable zstd stream in rs. The
+// seek table at the end of the stream is read up front.
+//
+// If rs is an io.ReaderAt, such as an *os.File, then ReadAt may be called from
+// many goroutines concurrently.
+func NewSeekableReader(rs io.ReadSeeker) (*SeekableReader, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := seekable.NewReader(rs, dec)
+	if err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return &SeekableReader{r: r, dec: dec}, nil
+}
+
+// Read reads decompressed bytes at the current offset.
+func (r *SeekableReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// Seek sets the offset of the next Read in the decompressed stream.
+func (r *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	return r.r.Seek(offset, whence)
+}
+
+// ReadAt reads decompressed bytes at offset off, without changing the offset
+// of Read.
+func (r *SeekableReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.r.ReadAt(p, off)
+}
+
+// Close releases the decoder and cached frame of r. It does not close the
+// underlying stream.
+func (r *SeekableReader) Close() error {
+	err := r.r.Close()
+	r.dec.Close()
+	return err
+}
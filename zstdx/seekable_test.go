@@ -0,0 +1,128 @@
+package zstdx
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"math/rand"
+	"testing"
+
+	seekable "github.com/SaveTheRbtz/zstd-seekable-format-go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestSeekableReader(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+		src := b.Bytes()
+		compressed := toSeekable(t, src, 1+rand.Intn(4096))
+
+		x0, x1 := rand.Intn(w), rand.Intn(w)+1
+		y0, y1 := rand.Intn(h), rand.Intn(h)+1
+		region := image.Rect(x0, y0, x1, y1).Intersect(image.Rect(0, 0, w, h))
+		if region.Empty() {
+			region = image.Rect(0, 0, w, h)
+		}
+		var want bytes.Buffer
+		require.NoError(t, bmpx.Crop(bytes.NewReader(src), &want, region))
+
+		r, err := NewSeekableReader(bytes.NewReader(compressed))
+		require.NoError(t, err)
+		var got bytes.Buffer
+		require.NoError(t, bmpx.Crop(r, &got, region))
+		require.Equal(t, want.Bytes(), got.Bytes())
+
+		got.Reset()
+		require.NoError(t, bmpx.CropAt(r, &got, region))
+		require.Equal(t, want.Bytes(), got.Bytes())
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestSeekableReaderSkipsFrames(t *testing.T) {
+	const w, h = 100, 400
+	var b bytes.Buffer
+	require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+	src := b.Bytes()
+	compressed := toSeekable(t, src, 1024)
+
+	// Rows of the bottom-up image are stored last row first, so the region is
+	// near the start of the stream
+	region := image.Rect(10, h-20, 30, h-10)
+	var want bytes.Buffer
+	require.NoError(t, bmpx.Crop(bytes.NewReader(src), &want, region))
+
+	for _, crop := range []func(r *SeekableReader, dst io.Writer) error{
+		func(r *SeekableReader, dst io.Writer) error { return bmpx.Crop(r, dst, region) },
+		func(r *SeekableReader, dst io.Writer) error { return bmpx.CropAt(r, dst, region) },
+	} {
+		cr := &countingReader{ReadSeeker: bytes.NewReader(compressed)}
+		r, err := NewSeekableReader(cr)
+		require.NoError(t, err)
+		var got bytes.Buffer
+		require.NoError(t, crop(r, &got))
+		require.Equal(t, want.Bytes(), got.Bytes())
+		require.Less(t, cr.n, len(compressed)/4)
+		require.NoError(t, r.Close())
+	}
+}
+
+// toSeekable compresses b to the zstd seekable format, with frames that hold
+// frameSize bytes of b.
+func toSeekable(t *testing.T, b []byte, frameSize int) []byte {
+	enc, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer enc.Close()
+	var res bytes.Buffer
+	w, err := seekable.NewWriter(&res, enc)
+	require.NoError(t, err)
+	for len(b) > 0 {
+		n := frameSize
+		if n > len(b) {
+			n = len(b)
+		}
+		_, err := w.Write(b[:n])
+		require.NoError(t, err)
+		b = b[n:]
+	}
+	require.NoError(t, w.Close())
+	return res.Bytes()
+}
+
+// countingReader counts the number of bytes that are read from the
+// underlying stream.
+type countingReader struct {
+	io.ReadSeeker
+	n     int
+	calls int // Number of ReadAt calls
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	r.n += n
+	return n, err
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.ReadSeeker.(io.ReaderAt).ReadAt(p, off)
+	r.n += n
+	r.calls++
+	return n, err
+}
+
+func randRGB(w, h int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(rand.Intn(256)), uint8(rand.Intn(256)), uint8(rand.Intn(256)), 255})
+		}
+	}
+	return img
+}
@@ -0,0 +1,69 @@
+package zstdx
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// MaxWindow is the largest window size of the zstd streams that are read by
+// Reader and written by Writer. The window bounds the memory that is needed to
+// decompress a stream, regardless of the size of the image it holds. It fits
+// streams written by the zstd command at levels up to 19 without --long.
+const MaxWindow = 8 << 20
+
+// Reader decompresses a plain (non-seekable) zstd stream as it is being read,
+// such as a BMP that has been compressed with the zstd command.
+//
+// Decompression happens on the goroutine that calls Read, using memory bounded
+// by MaxWindow. Passing a Reader to bmpx.Crop decompresses the rows that
+// precede the region and discards them, and stops reading after the last row
+// of the region.
+type Reader struct {
+	dec *zstd.Decoder
+}
+
+// NewReader returns a reader of the decompressed contents of the zstd stream
+// in r. Reading a stream with a window larger than MaxWindow fails with
+// zstd.ErrWindowSizeExceeded.
+func NewReader(r io.Reader) (*Reader, error) {
+	dec, err := zstd.NewReader(r,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderLowmem(true),
+		zstd.WithDecoderMaxWindow(MaxWindow),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{dec: dec}, nil
+}
+
+// Read reads decompressed bytes.
+func (r *Reader) Read(p []byte) (int, error) {
+	return r.dec.Read(p)
+}
+
+// Close releases the decoder of r. It does not close the underlying stream.
+func (r *Reader) Close() error {
+	r.dec.Close()
+	return nil
+}
+
+// NewWriter returns a writer that compresses to a plain zstd stream in w with
+// the provided level, which is zstd.SpeedDefault if zero. The stream can be
+// read by Reader, and by the zstd command. Close must be called to write the
+// end of the stream.
+func NewWriter(w io.Writer, level zstd.EncoderLevel) (io.WriteCloser, error) {
+	if level == 0 {
+		level = zstd.SpeedDefault
+	}
+	enc, err := zstd.NewWriter(w,
+		zstd.WithEncoderLevel(level),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithWindowSize(MaxWindow),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
@@ -0,0 +1,92 @@
+package zstdx
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/sebnyberg/imgcrop/bmpx"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/bmp"
+)
+
+func TestReader(t *testing.T) {
+	levels := []zstd.EncoderLevel{0, zstd.SpeedFastest, zstd.SpeedBestCompression}
+	for i := 0; i < 20; i++ {
+		w := 1 + rand.Intn(200)
+		h := 1 + rand.Intn(200)
+		var b bytes.Buffer
+		require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+		src := b.Bytes()
+
+		var compressed bytes.Buffer
+		zw, err := NewWriter(&compressed, levels[i%len(levels)])
+		require.NoError(t, err)
+		_, err = zw.Write(src)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		x0, y0 := rand.Intn(w), rand.Intn(h)
+		region := image.Rect(x0, y0, x0+1+rand.Intn(w-x0), y0+1+rand.Intn(h-y0))
+		var want bytes.Buffer
+		require.NoError(t, bmpx.Crop(bytes.NewReader(src), &want, region))
+
+		// Crop from a compressed stream to a compressed stream
+		r, err := NewReader(&compressed)
+		require.NoError(t, err)
+		var got bytes.Buffer
+		zw, err = NewWriter(&got, 0)
+		require.NoError(t, err)
+		require.NoError(t, bmpx.Crop(r, zw, region))
+		require.NoError(t, zw.Close())
+		require.NoError(t, r.Close())
+
+		r, err = NewReader(&got)
+		require.NoError(t, err)
+		cropped, err := io.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, want.Bytes(), cropped)
+		require.NoError(t, r.Close())
+	}
+}
+
+func TestReaderStopsAfterRegion(t *testing.T) {
+	const w, h = 500, 1000
+	var b bytes.Buffer
+	require.NoError(t, bmp.Encode(&b, randRGB(w, h)))
+	var compressed bytes.Buffer
+	zw, err := NewWriter(&compressed, zstd.SpeedFastest)
+	require.NoError(t, err)
+	_, err = zw.Write(b.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	// Rows of the bottom-up image are stored last row first, so the region is
+	// near the start of the stream
+	cr := &countingReader{ReadSeeker: bytes.NewReader(compressed.Bytes())}
+	r, err := NewReader(cr)
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, bmpx.Crop(r, io.Discard, image.Rect(0, h-100, w, h-90)))
+	require.Less(t, cr.n, compressed.Len()/4)
+}
+
+func TestReaderMaxWindow(t *testing.T) {
+	var compressed bytes.Buffer
+	enc, err := zstd.NewWriter(&compressed, zstd.WithWindowSize(4*MaxWindow))
+	require.NoError(t, err)
+	src := make([]byte, 4*MaxWindow)
+	rand.Read(src)
+	_, err = enc.Write(src)
+	require.NoError(t, err)
+	require.NoError(t, enc.Close())
+
+	r, err := NewReader(&compressed)
+	require.NoError(t, err)
+	defer r.Close()
+	_, err = io.Copy(io.Discard, r)
+	require.ErrorIs(t, err, zstd.ErrWindowSizeExceeded)
+}